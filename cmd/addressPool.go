@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long an address that failed to connect is skipped, doubled per consecutive failure
+const (
+	addressRetryMin = 1 * time.Second
+	addressRetryMax = 30 * time.Second
+)
+
+// poolAddress is one data address of the endpoint and its health
+type poolAddress struct {
+	addr      string
+	open      int64 // connections currently open
+	streak    int   // consecutive dial failures
+	downUntil time.Time
+}
+
+// addressPool spreads the connections to the endpoint host over several
+// addresses. Addresses come from --endpoint-addresses, or from every A/AAAA
+// record of the host when the list is "dns". Dials to other hosts are left alone.
+type addressPool struct {
+	host     string
+	balance  string
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	mu       sync.Mutex
+	addrs    []*poolAddress
+	next     int
+	resolved bool
+}
+
+func newAddressPool(host string, addresses []string, balance string, dialer *net.Dialer) (*addressPool, error) {
+	if host == "" {
+		return nil, fmt.Errorf("--endpoint-addresses needs --endpoint-url")
+	}
+	if balance != "round-robin" && balance != "least-loaded" {
+		return nil, fmt.Errorf("unknown endpoint balance %q, use round-robin or least-loaded", balance)
+	}
+	p := &addressPool{host: strings.ToLower(host), balance: balance, dial: dialer.DialContext}
+	if len(addresses) == 1 && addresses[0] == "dns" {
+		return p, nil
+	}
+	for _, a := range addresses {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+		p.addrs = append(p.addrs, &poolAddress{addr: a})
+	}
+	if len(p.addrs) == 0 {
+		return nil, fmt.Errorf("--endpoint-addresses is empty")
+	}
+	p.resolved = true
+	return p, nil
+}
+
+// the endpoint host and its virtual-hosted bucket sub domains go through the pool
+func (p *addressPool) matches(host string) bool {
+	host = strings.ToLower(host)
+	return host == p.host || strings.HasSuffix(host, "."+p.host)
+}
+
+func (p *addressPool) lookup(ctx context.Context) error {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, p.host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		p.addrs = append(p.addrs, &poolAddress{addr: ip.String()})
+	}
+	if len(p.addrs) == 0 {
+		return fmt.Errorf("no addresses found for %s", p.host)
+	}
+	p.resolved = true
+	logger.Info("endpoint addresses resolved", "host", p.host, "addresses", p.names())
+	return nil
+}
+
+func (p *addressPool) names() []string {
+	var names []string
+	for _, a := range p.addrs {
+		names = append(names, a.addr)
+	}
+	return names
+}
+
+// Picks the next healthy address, or the one that recovers soonest when all are down.
+// The caller holds p.mu.
+func (p *addressPool) pick(skip map[*poolAddress]bool) *poolAddress {
+	now := time.Now()
+	var best, soonest *poolAddress
+	for n := 0; n < len(p.addrs); n++ {
+		a := p.addrs[(p.next+n)%len(p.addrs)]
+		if skip[a] {
+			continue
+		}
+		if now.Before(a.downUntil) {
+			if soonest == nil || a.downUntil.Before(soonest.downUntil) {
+				soonest = a
+			}
+			continue
+		}
+		if best == nil {
+			best = a
+			if p.balance == "round-robin" {
+				break
+			}
+		} else if atomic.LoadInt64(&a.open) < atomic.LoadInt64(&best.open) {
+			best = a
+		}
+	}
+	p.next++
+	if best == nil {
+		return soonest
+	}
+	return best
+}
+
+// DialContext for http.Transport, each failed address is marked down and the next one tried
+func (p *addressPool) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || !p.matches(host) {
+		return p.dial(ctx, network, address)
+	}
+
+	p.mu.Lock()
+	if !p.resolved {
+		if err := p.lookup(ctx); err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+	}
+	p.mu.Unlock()
+
+	skip := make(map[*poolAddress]bool)
+	var lastErr error
+	for {
+		p.mu.Lock()
+		a := p.pick(skip)
+		p.mu.Unlock()
+		if a == nil {
+			return nil, lastErr
+		}
+		skip[a] = true
+
+		target := a.addr
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			target = net.JoinHostPort(target, port)
+		}
+		conn, err := p.dial(ctx, network, target)
+		p.mu.Lock()
+		if err != nil {
+			a.streak++
+			retry := addressRetryMin << (a.streak - 1)
+			if retry > addressRetryMax || retry <= 0 {
+				retry = addressRetryMax
+			}
+			a.downUntil = time.Now().Add(retry)
+			p.mu.Unlock()
+			logger.Debug("endpoint address down", "address", a.addr, "retry_in", retry, "error", err)
+			lastErr = err
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			continue
+		}
+		if a.streak > 0 {
+			logger.Debug("endpoint address back up", "address", a.addr)
+		}
+		a.streak = 0
+		a.downUntil = time.Time{}
+		p.mu.Unlock()
+
+		atomic.AddInt64(&a.open, 1)
+		logTrace("dialed", "address", target, "host", address)
+		return &pooledConn{Conn: conn, addr: a}, nil
+	}
+}
+
+// pooledConn releases its address slot once closed
+type pooledConn struct {
+	net.Conn
+	addr   *poolAddress
+	closed int32
+}
+
+func (c *pooledConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		atomic.AddInt64(&c.addr.open, -1)
+	}
+	return c.Conn.Close()
+}
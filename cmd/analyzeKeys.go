@@ -0,0 +1,416 @@
+/*
+Copyright © 2023 Jean-Baptiste Thomas <jboothomas@gmail.com>
+This file is part of CLI application pS3.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+// analyzeKeysCmd represents the analyze-keys command
+var analyzeKeysCmd = &cobra.Command{
+	Use:   "analyze-keys",
+	Short: "Reports how the keys of a bucket are distributed.",
+	Long: `Lists the bucket with the prefix discovery engine of list-objects-v2 and reports, instead of the objects:
+
+  - the object count of the prefixes at each depth up to --depth, with the prefix the keys under each share
+  - the characters the keys use, and the ones prefix discovery does not probe and sweeps key ranges for
+  - hotspots, the prefixes holding several times the objects of the other prefixes at their depth, on average
+  - the partitions discovery listed the bucket in and how evenly they share the work of --workers
+
+Use it before designing a key layout, or to find out why a bucket lists slowly.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fBucketName, _ := cmd.Flags().GetString("bucket")
+		fPrefixCount, _ := cmd.Flags().GetString("prefix-count")
+		fDepth, _ := cmd.Flags().GetInt("depth")
+		fTop, _ := cmd.Flags().GetInt("top")
+		fEncodingType, _ := cmd.Flags().GetString("encoding-type")
+		analyzeKeys(fBucketName, fPrefixCount, fDepth, fTop, fEncodingType, fEndpointUrl, fProfile, fRegion, fNoVerifySSL, fOutput)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(analyzeKeysCmd)
+
+	analyzeKeysCmd.Flags().String("bucket", "", "Bucket name to analyze, or file:///path for a local or NFS directory (required)")
+	analyzeKeysCmd.MarkFlagRequired("bucket")
+	analyzeKeysCmd.Flags().String("prefix-count", "500", "Prefix count for discovery, as for list-objects-v2, or auto.")
+	analyzeKeysCmd.Flags().Int("depth", 3, "Report the prefixes of up to this many characters.")
+	analyzeKeysCmd.Flags().Int("top", 10, "Number of prefixes to show per depth and of hotspots.")
+	analyzeKeysCmd.Flags().String("encoding-type", "", "Set to url to have S3 URL encode the keys it returns, needed for keys with characters XML cannot carry.")
+}
+
+// a prefix is a hotspot with this many times the objects of the other prefixes at its depth, on average
+const hotspotRatio = 4
+
+// prefixObjects is a prefix and the keys under it
+type prefixObjects struct {
+	Prefix  string  `json:"prefix"`
+	Objects int64   `json:"objects"`
+	Share   float64 `json:"share"`
+	Common  string  `json:"common_prefix"` //longest prefix of all the keys under it
+}
+
+// depthReport is the prefixes of one length
+type depthReport struct {
+	Depth    int             `json:"depth"`
+	Prefixes int             `json:"prefixes"`
+	Min      int64           `json:"min_objects"`
+	Median   int64           `json:"median_objects"`
+	Max      int64           `json:"max_objects"`
+	Top      []prefixObjects `json:"top"`
+}
+
+type charCount struct {
+	Char   string `json:"char"`
+	Count  int64  `json:"count"`
+	Probed bool   `json:"probed"` //one of the characters prefix discovery probes, the others are listed by range sweeps
+}
+
+type hotspot struct {
+	prefixObjects
+	Depth int     `json:"depth"`
+	Ratio float64 `json:"ratio"` //to the average of the other prefixes at the depth
+}
+
+// partitionBalance is how evenly the prefixes discovery listed share the listing
+type partitionBalance struct {
+	Partitions     int     `json:"partitions"`
+	Large          int     `json:"large"` //listed in parallel, the others by their probe
+	Largest        string  `json:"largest"`
+	LargestFrom    string  `json:"largest_from,omitempty"` //set when the largest partition is a key range of its prefix
+	LargestBefore  string  `json:"largest_before,omitempty"`
+	LargestObjects int64   `json:"largest_objects"`
+	MeanObjects    float64 `json:"mean_objects"`
+	CV             float64 `json:"coefficient_of_variation"`
+	LargestPages   int64   `json:"largest_pages"`
+	IdealRounds    int64   `json:"ideal_rounds"` //pages per worker if all were spread evenly
+	Balance        float64 `json:"balance"`      //ideal rounds over the rounds of the largest partition, 1 is even
+}
+
+// keyReport is the analyze-keys command output
+type keyReport struct {
+	Bucket       string           `json:"bucket"`
+	Objects      int64            `json:"objects"`
+	Bytes        int64            `json:"bytes"`
+	MinKeyLength int              `json:"min_key_length"`
+	AvgKeyLength float64          `json:"avg_key_length"`
+	MaxKeyLength int              `json:"max_key_length"`
+	CommonPrefix string           `json:"common_prefix"`
+	Characters   []charCount      `json:"characters"`
+	Depths       []depthReport    `json:"depths"`
+	Hotspots     []hotspot        `json:"hotspots"`
+	Partitions   partitionBalance `json:"partitions"`
+}
+
+// prefixKeys is what keyAnalyzer keeps of a prefix: its keys and the first and last of them
+type prefixKeys struct {
+	objects     int64
+	first, last string
+}
+
+func (p *prefixKeys) add(key string) {
+	if p.objects == 0 || key < p.first {
+		p.first = key
+	}
+	if p.objects == 0 || key > p.last {
+		p.last = key
+	}
+	p.objects++
+}
+
+// keyAnalyzer tallies the listed keys, they come in no particular order
+type keyAnalyzer struct {
+	depth    int
+	prefixes []map[string]*prefixKeys //by depth - 1
+	all      prefixKeys
+	bytes    int64
+	keyBytes int64
+	minKey   int
+	maxKey   int
+	chars    map[rune]int64
+}
+
+func newKeyAnalyzer(depth int) *keyAnalyzer {
+	a := &keyAnalyzer{depth: depth, prefixes: make([]map[string]*prefixKeys, depth), chars: make(map[rune]int64)}
+	for i := range a.prefixes {
+		a.prefixes[i] = make(map[string]*prefixKeys)
+	}
+	return a
+}
+
+func (a *keyAnalyzer) add(object *s3.Object) {
+	key := *object.Key
+	if a.all.objects == 0 || len(key) < a.minKey {
+		a.minKey = len(key)
+	}
+	if len(key) > a.maxKey {
+		a.maxKey = len(key)
+	}
+	a.all.add(key)
+	a.keyBytes += int64(len(key))
+	if object.Size != nil {
+		a.bytes += *object.Size
+	}
+	for _, c := range key {
+		a.chars[c]++
+	}
+	//prefixes of 1 to depth characters, never cut inside one
+	for d, end := 0, 0; d < a.depth && end < len(key); d++ {
+		_, size := utf8.DecodeRuneInString(key[end:])
+		end += size
+		p := a.prefixes[d][key[:end]]
+		if p == nil {
+			p = &prefixKeys{}
+			a.prefixes[d][key[:end]] = p
+		}
+		p.add(key)
+	}
+}
+
+// Returns the longest common prefix of a and b that does not end inside a character
+func commonPrefix(a string, b string) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	for i > 0 && i < len(a) && !utf8.RuneStart(a[i]) {
+		i--
+	}
+	return a[:i]
+}
+
+func analyzeKeys(fBucketName string, fPrefixCount string, fDepth int, fTop int, fEncodingType string, fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool, fOutput string) {
+
+	logTrace("analyze-keys", "bucket", fBucketName, "endpoint", fEndpointUrl, "prefix_count", fPrefixCount, "depth", fDepth)
+
+	prefixCount, autoPrefixCount, err := parsePrefixCount(fPrefixCount)
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+	if fDepth < 1 {
+		log.Fatalln("error: --depth must be at least 1")
+	}
+	svc, _ := newListingService(fBucketName, false, fEncodingType, fEndpointUrl, fProfile, fRegion, fNoVerifySSL)
+
+	//the plan of the run is the partitions discovery listed
+	planRecorder = newPrefixPlan(fBucketName, prefixCount)
+
+	chs3Object := make(chan []*s3.Object, objectBatchQueue)
+	var prefixes []keyRange
+	var wg sync.WaitGroup
+	go func() {
+		svc = discoverBucket(svc, fBucketName, prefixCount, autoPrefixCount, chs3Object, &wg, &prefixes, fDebug)
+		wg.Wait()
+		listObjectsInParallel(svc, fBucketName, prefixes, chs3Object, &wg, fDebug)
+		wg.Wait()
+		close(chs3Object)
+	}()
+
+	a := newKeyAnalyzer(fDepth)
+	for batch := range chs3Object {
+		for _, object := range batch {
+			a.add(object)
+		}
+	}
+	logger.Info("objects analyzed", "bucket", fBucketName, "objects", a.all.objects)
+
+	report := a.report(fBucketName, fTop)
+	report.Partitions = partitionBalanceOf(planRecorder, maxSemaphore)
+	printKeyReport(report, fOutput)
+}
+
+func (a *keyAnalyzer) report(fBucketName string, fTop int) *keyReport {
+	r := &keyReport{
+		Bucket:       fBucketName,
+		Objects:      a.all.objects,
+		Bytes:        a.bytes,
+		MinKeyLength: a.minKey,
+		MaxKeyLength: a.maxKey,
+		CommonPrefix: commonPrefix(a.all.first, a.all.last),
+	}
+	if a.all.objects == 0 {
+		return r
+	}
+	r.AvgKeyLength = float64(a.keyBytes) / float64(a.all.objects)
+
+	probed := make(map[byte]bool)
+	for _, c := range characters {
+		probed[c[0]] = true
+	}
+	for c, count := range a.chars {
+		r.Characters = append(r.Characters, charCount{Char: string(c), Count: count, Probed: c < utf8.RuneSelf && probed[byte(c)]})
+	}
+	sort.Slice(r.Characters, func(i, j int) bool {
+		if r.Characters[i].Count != r.Characters[j].Count {
+			return r.Characters[i].Count > r.Characters[j].Count
+		}
+		return r.Characters[i].Char < r.Characters[j].Char
+	})
+
+	prefixObjectsOf := func(prefix string, p *prefixKeys) prefixObjects {
+		return prefixObjects{Prefix: prefix, Objects: p.objects, Share: float64(p.objects) / float64(a.all.objects), Common: commonPrefix(p.first, p.last)}
+	}
+	for i, level := range a.prefixes {
+		if len(level) == 0 {
+			break
+		}
+		counts := make([]prefixObjects, 0, len(level))
+		for prefix, p := range level {
+			counts = append(counts, prefixObjectsOf(prefix, p))
+		}
+		sort.Slice(counts, func(i, j int) bool {
+			if counts[i].Objects != counts[j].Objects {
+				return counts[i].Objects > counts[j].Objects
+			}
+			return counts[i].Prefix < counts[j].Prefix
+		})
+
+		d := depthReport{Depth: i + 1, Prefixes: len(counts), Max: counts[0].Objects, Median: counts[len(counts)/2].Objects, Min: counts[len(counts)-1].Objects}
+		var total int64
+		for _, c := range counts {
+			total += c.Objects
+		}
+		//a lone prefix is no hotspot, whatever it holds
+		for _, c := range counts {
+			if len(counts) == 1 {
+				break
+			}
+			others := float64(total-c.Objects) / float64(len(counts)-1)
+			if ratio := float64(c.Objects) / others; ratio >= hotspotRatio {
+				r.Hotspots = append(r.Hotspots, hotspot{prefixObjects: c, Depth: i + 1, Ratio: ratio})
+			}
+		}
+		if len(counts) > fTop {
+			counts = counts[:fTop]
+		}
+		d.Top = counts
+		r.Depths = append(r.Depths, d)
+	}
+	sort.SliceStable(r.Hotspots, func(i, j int) bool { return r.Hotspots[i].Ratio > r.Hotspots[j].Ratio })
+	if len(r.Hotspots) > fTop {
+		r.Hotspots = r.Hotspots[:fTop]
+	}
+	return r
+}
+
+// How evenly the prefixes of plan, as listed by one run, spread over workers
+func partitionBalanceOf(plan *prefixPlan, workers int) partitionBalance {
+	var b partitionBalance
+	var objects []int64
+	var totalPages int64
+	for _, e := range plan.Prefixes {
+		if e.Exact || e.Objects == 0 {
+			continue
+		}
+		objects = append(objects, e.Objects)
+		if e.Objects > b.LargestObjects {
+			b.Largest, b.LargestFrom, b.LargestBefore, b.LargestObjects = e.Prefix, e.From, e.Before, e.Objects
+		}
+		//small prefixes are listed by their probe, large ones page by page
+		if e.Objects > 999 {
+			b.Large++
+		}
+		totalPages += (e.Objects + maxKeys - 1) / maxKeys
+	}
+	b.Partitions = len(objects)
+	if b.Partitions == 0 {
+		return b
+	}
+
+	var sum, squares float64
+	for _, n := range objects {
+		sum += float64(n)
+		squares += float64(n) * float64(n)
+	}
+	b.MeanObjects = sum / float64(b.Partitions)
+	b.CV = math.Sqrt(math.Max(squares/float64(b.Partitions)-b.MeanObjects*b.MeanObjects, 0)) / b.MeanObjects
+
+	b.LargestPages = (b.LargestObjects + maxKeys - 1) / maxKeys
+	b.IdealRounds = (totalPages + int64(workers) - 1) / int64(workers)
+	b.Balance = float64(b.IdealRounds) / float64(max64(b.LargestPages, b.IdealRounds))
+	return b
+}
+
+func max64(a int64, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// a prefix or key as one printable line
+func printableKey(key string) string {
+	return string(appendEscapedKey(nil, key))
+}
+
+func printKeyReport(r *keyReport, fOutput string) {
+	if fOutput == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(r); err != nil {
+			log.Fatalln("error:", err)
+		}
+		return
+	}
+
+	fmt.Printf("bucket: %s  objects: %d  size: %s\n", r.Bucket, r.Objects, humanSize(r.Bytes))
+	if r.Objects == 0 {
+		return
+	}
+	fmt.Printf("key length: min %d  avg %.1f  max %d\n", r.MinKeyLength, r.AvgKeyLength, r.MaxKeyLength)
+	fmt.Printf("common prefix: %q\n", r.CommonPrefix)
+
+	var used, unprobed strings.Builder
+	for _, c := range r.Characters {
+		used.WriteString(c.Char)
+		if !c.Probed {
+			unprobed.WriteString(c.Char)
+		}
+	}
+	fmt.Printf("\ncharacters: %d used, most frequent first: %q\n", len(r.Characters), used.String())
+	if unprobed.Len() > 0 {
+		fmt.Printf("not probed by prefix discovery, listed by range sweeps: %q\n", unprobed.String())
+	}
+
+	for _, d := range r.Depths {
+		fmt.Printf("\ndepth %d: %d prefixes, objects min %d  median %d  max %d\n", d.Depth, d.Prefixes, d.Min, d.Median, d.Max)
+		fmt.Printf("  %-16s %12s %7s  %s\n", "PREFIX", "OBJECTS", "SHARE", "COMMON PREFIX")
+		for _, c := range d.Top {
+			fmt.Printf("  %-16s %12d %6.1f%%  %s\n", printableKey(c.Prefix), c.Objects, c.Share*100, printableKey(c.Common))
+		}
+	}
+
+	fmt.Printf("\nhotspots, %dx the average of the other prefixes at their depth or more:\n", hotspotRatio)
+	if len(r.Hotspots) == 0 {
+		fmt.Println("  none")
+	}
+	for _, h := range r.Hotspots {
+		fmt.Printf("  %-16s depth %d  %12d objects %6.1f%%  %5.1fx\n", printableKey(h.Prefix), h.Depth, h.Objects, h.Share*100, h.Ratio)
+	}
+
+	b := r.Partitions
+	fmt.Printf("\npartitions: %d, %d listed in parallel\n", b.Partitions, b.Large)
+	largest := printableKey(b.Largest)
+	if b.LargestFrom != "" {
+		largest += " from " + printableKey(b.LargestFrom)
+	}
+	if b.LargestBefore != "" {
+		largest += " before " + printableKey(b.LargestBefore)
+	}
+	fmt.Printf("  largest %s with %d objects, %d pages\n", largest, b.LargestObjects, b.LargestPages)
+	fmt.Printf("  mean %.0f objects, coefficient of variation %.2f\n", b.MeanObjects, b.CV)
+	fmt.Printf("  balance %.2f before straggler splits: %d pages per worker if spread evenly, %d in the largest partition\n", b.Balance, b.IdealRounds, b.LargestPages)
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import "testing"
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want string
+	}{
+		{"abc", "abd", "ab"},
+		{"abc", "abc", "abc"},
+		{"ab", "abc", "ab"},
+		{"", "a", ""},
+		{"p/é1", "p/è1", "p/"}, //é and è share their first byte
+		{"k日", "k早", "k"},      //日 and 早 share their first two bytes
+		{"x日", "x日本", "x日"},
+	}
+	for _, tt := range tests {
+		if got := commonPrefix(tt.a, tt.b); got != tt.want {
+			t.Errorf("commonPrefix(%q, %q) = %q, want %q", tt.a, tt.b, got, tt.want)
+		}
+		if got := commonPrefix(tt.b, tt.a); got != tt.want {
+			t.Errorf("commonPrefix(%q, %q) = %q, want %q", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,413 @@
+/*
+Copyright © 2023 Jean-Baptiste Thomas <jboothomas@gmail.com>
+This file is part of CLI application pS3.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+// benchCmd represents the bench command
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "Measures PUT, GET, HEAD, LIST and DELETE throughput and latency.",
+	Long: `Writes synthetic objects under a run prefix of the bucket, then reads, heads, lists and deletes them
+at the given concurrency, using the same HTTP client tuning as the other pS3 commands.
+
+The pipeline phase sends --objects synthetic listed objects from --concurrency listers through the
+list-objects-v2 output pipeline, without S3, and reports the objects written per second. Compare it
+with the objects per second of the list phase to see whether listing is bound by output.
+
+Sizes are a single value or a min-max range picked uniformly, e.g. 4KiB or 1KiB-1MiB.
+--key-shape takes one of ` + strings.Join(keyShapeNames(), ", ") + ` or a key template.
+
+` + keyTemplateHelp,
+	Run: func(cmd *cobra.Command, args []string) {
+		fBucketName, _ := cmd.Flags().GetString("bucket")
+		fObjects, _ := cmd.Flags().GetInt("objects")
+		fSize, _ := cmd.Flags().GetString("size")
+		fKeyShape, _ := cmd.Flags().GetString("key-shape")
+		fConcurrency, _ := cmd.Flags().GetInt("concurrency")
+		fOps, _ := cmd.Flags().GetString("ops")
+		fListCount, _ := cmd.Flags().GetInt("list-count")
+		fPrefix, _ := cmd.Flags().GetString("prefix")
+		fSeed, _ := cmd.Flags().GetInt64("seed")
+		bench(fBucketName, fObjects, fSize, fKeyShape, fConcurrency, fOps, fListCount, fPrefix, fSeed, fEndpointUrl, fProfile, fRegion, fNoVerifySSL, fOutput)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(benchCmd)
+
+	benchCmd.Flags().String("bucket", "", "Bucket to benchmark against (required)")
+	benchCmd.MarkFlagRequired("bucket")
+	benchCmd.Flags().Int("objects", 1000, "Number of objects to write, read, head and delete.")
+	benchCmd.Flags().String("size", "4KiB", "Object size, or min-max range, e.g. 1KiB-1MiB.")
+	benchCmd.Flags().String("key-shape", "uuid", "Key distribution: "+strings.Join(keyShapeNames(), ", ")+", or a key template.")
+	benchCmd.Flags().Int("concurrency", 64, "Number of requests in flight.")
+	benchCmd.Flags().String("ops", "put,get,head,list,delete", "Comma separated phases to run, in order: put, get, head, list, delete or pipeline.")
+	benchCmd.Flags().Int("list-count", 100, "Number of LIST requests in the list phase.")
+	benchCmd.Flags().String("prefix", "", "Prefix for the benchmark objects (default pS3-bench/<timestamp>/).")
+	benchCmd.Flags().Int64("seed", 1, "Seed for sizes and keys, reuse it to get/head/delete the objects of an earlier put.")
+}
+
+// benchResult is the outcome of one phase
+type benchResult struct {
+	Operation     string  `json:"operation"`
+	Requests      int     `json:"requests"` //none for PIPELINE, which makes no S3 calls
+	Errors        int     `json:"errors"`
+	Bytes         int64   `json:"bytes"`
+	Objects       int64   `json:"objects"` //written, read, listed or deleted
+	Seconds       float64 `json:"seconds"`
+	OpsPerSec     float64 `json:"ops_per_sec"`
+	ObjectsPerSec float64 `json:"objects_per_sec"`
+	MiBPerSec     float64 `json:"mib_per_sec"`
+	P50Ms         float64 `json:"p50_ms"`
+	P90Ms         float64 `json:"p90_ms"`
+	P99Ms         float64 `json:"p99_ms"`
+	MaxMs         float64 `json:"max_ms"`
+}
+
+// Parses 1024, 4KB, 4KiB, 1.5MiB...
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	units := []struct {
+		suffix string
+		mult   float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"T", 1 << 40},
+		{"B", 1},
+	}
+	mult := 1.0
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(v * mult), nil
+}
+
+// Parses a size or min-max size range
+func parseSizeRange(s string) (int64, int64, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	min, err := parseByteSize(lo)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return min, min, nil
+	}
+	max, err := parseByteSize(hi)
+	if err != nil {
+		return 0, 0, err
+	}
+	if max < min {
+		return 0, 0, fmt.Errorf("invalid size range %q", s)
+	}
+	return min, max, nil
+}
+
+// value below which p percent of the sorted latencies fall
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Runs fn for 0..n-1 with concurrency workers and summarises the latencies.
+// fn returns the bytes and objects moved by the request.
+func runBenchPhase(op string, n int, concurrency int, fn func(i int) (int64, int64, error)) benchResult {
+	latencies := make([]time.Duration, n)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var bytes, objects int64
+	errors := 0
+
+	next := make(chan int)
+	start := time.Now()
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				t := time.Now()
+				b, o, err := fn(i)
+				latencies[i] = time.Since(t)
+
+				mu.Lock()
+				if err != nil {
+					errors++
+					logger.Debug("bench request failed", "operation", op, "index", i, "error", err)
+				}
+				bytes += b
+				objects += o
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	r := benchResult{
+		Operation: op,
+		Requests:  n,
+		Errors:    errors,
+		Bytes:     bytes,
+		Objects:   objects,
+		Seconds:   elapsed.Seconds(),
+		P50Ms:     durationMs(percentile(latencies, 50)),
+		P90Ms:     durationMs(percentile(latencies, 90)),
+		P99Ms:     durationMs(percentile(latencies, 99)),
+		MaxMs:     durationMs(percentile(latencies, 100)),
+	}
+	if r.Seconds > 0 {
+		r.OpsPerSec = float64(n) / r.Seconds
+		r.ObjectsPerSec = float64(objects) / r.Seconds
+		r.MiBPerSec = float64(bytes) / (1 << 20) / r.Seconds
+	}
+	logger.Info("bench phase done", "operation", op, "latency", elapsed)
+	return r
+}
+
+func bench(fBucketName string, fObjects int, fSize string, fKeyShape string, fConcurrency int, fOps string, fListCount int, fPrefix string, fSeed int64, fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool, fOutput string) {
+
+	logTrace("bench", "bucket", fBucketName, "objects", fObjects, "size", fSize, "key_shape", fKeyShape, "concurrency", fConcurrency, "ops", fOps, "prefix", fPrefix, "seed", fSeed)
+
+	minSize, maxSize, err := parseSizeRange(fSize)
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+	keyGen, err := newKeyGenerator(fKeyShape, fSeed)
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+	if fConcurrency < 1 {
+		log.Fatalln("error: --concurrency must be at least 1")
+	}
+	if fPrefix == "" {
+		fPrefix = "pS3-bench/" + time.Now().UTC().Format("20060102T150405") + "/"
+	}
+
+	//sizes are fixed per object index so every phase agrees on them
+	sizes := make([]int64, fObjects)
+	rnd := rand.New(rand.NewSource(fSeed))
+	for i := range sizes {
+		sizes[i] = minSize
+		if maxSize > minSize {
+			sizes[i] += rnd.Int63n(maxSize - minSize + 1)
+		}
+	}
+	payload := make([]byte, maxSize)
+	rnd.Read(payload)
+
+	key := func(i int) string { return fPrefix + keyGen(i) }
+
+	var svc *s3.S3
+
+	var results []benchResult
+	for _, op := range strings.Split(fOps, ",") {
+		op = strings.ToLower(strings.TrimSpace(op))
+		logger.Info("bench phase", "operation", op, "bucket", fBucketName, "prefix", fPrefix)
+
+		//the pipeline phase needs no bucket
+		if svc == nil && op != "pipeline" {
+			svc = newS3Service(fBucketName, fEndpointUrl, fProfile, fRegion, fNoVerifySSL)
+		}
+
+		switch op {
+		case "put":
+			results = append(results, runBenchPhase("PUT", fObjects, fConcurrency, func(i int) (int64, int64, error) {
+				_, err := svc.PutObject(&s3.PutObjectInput{
+					Bucket: aws.String(fBucketName),
+					Key:    aws.String(key(i)),
+					Body:   bytes.NewReader(payload[:sizes[i]]),
+				})
+				if err != nil {
+					return 0, 0, err
+				}
+				return sizes[i], 1, nil
+			}))
+		case "get":
+			results = append(results, runBenchPhase("GET", fObjects, fConcurrency, func(i int) (int64, int64, error) {
+				resp, err := svc.GetObject(&s3.GetObjectInput{
+					Bucket: aws.String(fBucketName),
+					Key:    aws.String(key(i)),
+				})
+				if err != nil {
+					return 0, 0, err
+				}
+				defer resp.Body.Close()
+				n, err := io.Copy(io.Discard, resp.Body)
+				return n, 1, err
+			}))
+		case "head":
+			results = append(results, runBenchPhase("HEAD", fObjects, fConcurrency, func(i int) (int64, int64, error) {
+				_, _, err := s3headObject(svc, fBucketName, key(i))
+				if err != nil {
+					return 0, 0, err
+				}
+				return 0, 1, nil
+			}))
+		case "list":
+			//pages start after random keys of the run so they can be requested in parallel
+			results = append(results, runBenchPhase("LIST", fListCount, fConcurrency, func(i int) (int64, int64, error) {
+				params := &s3.ListObjectsV2Input{
+					Bucket:  aws.String(fBucketName),
+					Prefix:  aws.String(fPrefix),
+					MaxKeys: aws.Int64(maxKeys),
+				}
+				if fObjects > 0 {
+					params.StartAfter = aws.String(key(int(mix64(uint64(fSeed)^uint64(i)) % uint64(fObjects))))
+				}
+				resp, err := svc.ListObjectsV2(params)
+				if err != nil {
+					return 0, 0, err
+				}
+				return 0, int64(len(resp.Contents)), nil
+			}))
+		case "delete":
+			results = append(results, runBenchPhase("DELETE", fObjects, fConcurrency, func(i int) (int64, int64, error) {
+				_, err := svc.DeleteObject(&s3.DeleteObjectInput{
+					Bucket: aws.String(fBucketName),
+					Key:    aws.String(key(i)),
+				})
+				if err != nil {
+					return 0, 0, err
+				}
+				return 0, 1, nil
+			}))
+		case "pipeline":
+			results = append(results, benchPipeline(fObjects, fConcurrency))
+		default:
+			log.Fatalln("error: unknown bench operation", op, "expected put, get, head, list, delete or pipeline")
+		}
+	}
+
+	printBenchResults(results, fOutput)
+}
+
+// counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// Pushes objects synthetic objects in pages of maxKeys from concurrency goroutines through
+// writeObjects, as list-objects-v2 does, and reports objects written per second
+func benchPipeline(objects int, concurrency int) benchResult {
+	page := make([]*s3.Object, maxKeys)
+	modified := time.Now().UTC()
+	for i := range page {
+		page[i] = &s3.Object{
+			Key:          aws.String(fmt.Sprintf("pS3-bench/pipeline/%020d", mix64(uint64(i)))),
+			Size:         aws.Int64(int64(i) * 4096),
+			LastModified: aws.Time(modified),
+		}
+	}
+
+	pages := make(chan int)
+	go func() {
+		for sent := 0; sent < objects; sent += len(page) {
+			n := len(page)
+			if objects-sent < n {
+				n = objects - sent
+			}
+			pages <- n
+		}
+		close(pages)
+	}()
+
+	ch := make(chan []*s3.Object, objectBatchQueue)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range pages {
+				ch <- page[:n]
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	out := &countingWriter{}
+	written, err := writeObjects(out, ch, encodeObjectText)
+	elapsed := time.Since(start)
+	r := benchResult{
+		Operation: "PIPELINE",
+		Bytes:     out.n,
+		Objects:   written,
+		Seconds:   elapsed.Seconds(),
+	}
+	if err != nil {
+		r.Errors = 1
+	}
+	if r.Seconds > 0 {
+		r.ObjectsPerSec = float64(written) / r.Seconds
+		r.MiBPerSec = float64(out.n) / (1 << 20) / r.Seconds
+	}
+	logger.Info("bench phase done", "operation", "pipeline", "objects", written, "latency", elapsed)
+	return r
+}
+
+func printBenchResults(results []benchResult, fOutput string) {
+	if fOutput == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(results)
+		return
+	}
+
+	fmt.Printf("%-8s %9s %7s %10s %10s %11s %10s %10s %10s %10s %10s\n", "OP", "REQUESTS", "ERRORS", "OPS/S", "OBJECTS", "OBJECTS/S", "MIB/S", "P50(ms)", "P90(ms)", "P99(ms)", "MAX(ms)")
+	for _, r := range results {
+		fmt.Printf("%-8s %9d %7d %10.1f %10d %11.1f %10.2f %10.2f %10.2f %10.2f %10.2f\n", r.Operation, r.Requests, r.Errors, r.OpsPerSec, r.Objects, r.ObjectsPerSec, r.MiBPerSec, r.P50Ms, r.P90Ms, r.P99Ms, r.MaxMs)
+	}
+}
@@ -0,0 +1,194 @@
+/*
+Copyright © 2023 Jean-Baptiste Thomas <jboothomas@gmail.com>
+This file is part of CLI application pS3.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// configCmd represents the config command
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Shows how pS3 is configured.",
+	Long: `Every persistent flag can also be set with a PS3_<FLAG> environment variable (for example
+PS3_ENDPOINT_URL or PS3_MAX_CONNS_PER_HOST) or in the config file. The first of these wins:
+
+  1. the command line flag
+  2. the PS3_<FLAG> environment variable
+  3. targets.<name>.<flag> for the target picked with --target, PS3_TARGET or the top level target key
+  4. http.<flag> or credentials.<flag> for the flags of those sections
+  5. a top level <flag> key
+  6. the flag default
+
+Example ~/.pS3.yaml:
+
+  target: lab
+  output: text
+  http:
+    max-conns-per-host: 64
+  targets:
+    lab:
+      endpoint-url: https://s3.lab.example.com
+      ca-bundle: /etc/pki/lab-ca.pem
+      access-key: LABKEY
+      secret-key: LABSECRET
+      addressing-style: path
+      workers: 512
+    aws:
+      region: eu-west-1
+      profile: prod
+      role-arn: arn:aws:iam::123456789012:role/lister
+      max-retries: 5`,
+}
+
+// configShowCmd represents the config show command
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Prints the effective configuration and where each value comes from.",
+	Run: func(cmd *cobra.Command, args []string) {
+		configShow(rootCmd.PersistentFlags(), fOutput)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+}
+
+// where each persistent flag value came from, filled by resolveConfig
+var configSources = map[string]string{}
+
+// flags whose values config show does not print
+var secretFlagNames = map[string]bool{"secret-key": true, "session-token": true}
+
+// name of the environment variable for a flag, e.g. PS3_ENDPOINT_URL
+func configEnvName(name string) string {
+	return "PS3_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// config file keys of a flag, most specific first, with their source names
+func configKeys(name string, target string) [][2]string {
+	var keys [][2]string
+	if target != "" {
+		keys = append(keys, [2]string{"targets." + target + "." + name, "target " + target})
+	}
+	for _, section := range []struct {
+		name  string
+		flags []string
+	}{{"http", httpFlagNames}, {"credentials", credentialFlagNames}} {
+		for _, n := range section.flags {
+			if n == name {
+				keys = append(keys, [2]string{section.name + "." + name, "config " + section.name})
+			}
+		}
+	}
+	return append(keys, [2]string{name, "config"})
+}
+
+// config file values as flag values, lists become comma separated
+func configValue(key string) string {
+	if list, ok := viper.Get(key).([]interface{}); ok {
+		var items []string
+		for _, item := range list {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	}
+	return viper.GetString(key)
+}
+
+// Sets the persistent flags not given on the command line from the environment and
+// the config file, in the order described in config --help.
+func resolveConfig(flags *pflag.FlagSet) error {
+	set := func(f *pflag.Flag) {
+		if f.Changed {
+			configSources[f.Name] = "flag"
+			return
+		}
+		configSources[f.Name] = "default"
+		if value, ok := os.LookupEnv(configEnvName(f.Name)); ok {
+			if err := f.Value.Set(value); err != nil {
+				fmt.Fprintln(os.Stderr, "error:", configEnvName(f.Name), ":", err)
+				os.Exit(1)
+			}
+			configSources[f.Name] = "env " + configEnvName(f.Name)
+			return
+		}
+		for _, key := range configKeys(f.Name, fTarget) {
+			if !viper.IsSet(key[0]) {
+				continue
+			}
+			if err := f.Value.Set(configValue(key[0])); err != nil {
+				fmt.Fprintln(os.Stderr, "error: config file", key[0], ":", err)
+				os.Exit(1)
+			}
+			configSources[f.Name] = key[1]
+			return
+		}
+	}
+
+	//the target decides which keys the other flags are read from
+	set(flags.Lookup("target"))
+	if fTarget != "" && !viper.IsSet("targets."+fTarget) {
+		return fmt.Errorf("target %q is not in the targets section of the config file", fTarget)
+	}
+
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name != "target" {
+			set(f)
+		}
+	})
+	return nil
+}
+
+type configSetting struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+func configShow(flags *pflag.FlagSet, fOutput string) {
+	settings := make(map[string]configSetting)
+	var names []string
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "help" {
+			return
+		}
+		value := f.Value.String()
+		if secretFlagNames[f.Name] && value != "" {
+			value = "********"
+		}
+		settings[f.Name] = configSetting{Value: value, Source: configSources[f.Name]}
+		names = append(names, f.Name)
+	})
+	sort.Strings(names)
+
+	if fOutput == "json" {
+		out, err := json.MarshalIndent(struct {
+			ConfigFile string                   `json:"config_file"`
+			Target     string                   `json:"target"`
+			Settings   map[string]configSetting `json:"settings"`
+		}{viper.ConfigFileUsed(), fTarget, settings}, "", "  ")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		fmt.Println(string(out))
+		return
+	}
+
+	fmt.Println("config file:", viper.ConfigFileUsed())
+	fmt.Println("target:     ", fTarget)
+	for _, name := range names {
+		fmt.Printf("%-26s %-40s %s\n", name, settings[name].Value, settings[name].Source)
+	}
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/processcreds"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// CredentialSettings selects where request credentials come from. Empty
+// settings keep the SDK default chain (environment, --profile, instance roles).
+type CredentialSettings struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	//external command printing credential_process JSON
+	CredentialProcess string
+
+	//role assumed with the credentials above, or with a web identity token
+	RoleARN              string
+	ExternalID           string
+	RoleSessionName      string
+	RoleDuration         time.Duration
+	WebIdentityTokenFile string
+	STSEndpoint          string
+}
+
+// Returns the credential settings selected by the persistent flags and config file
+func credentialSettingsFromFlags() CredentialSettings {
+	return CredentialSettings{
+		AccessKey:            fAccessKey,
+		SecretKey:            fSecretKey,
+		SessionToken:         fSessionToken,
+		CredentialProcess:    fCredentialProcess,
+		RoleARN:              fRoleARN,
+		ExternalID:           fExternalID,
+		RoleSessionName:      fRoleSessionName,
+		RoleDuration:         fRoleDuration,
+		WebIdentityTokenFile: fWebIdentityTokenFile,
+		STSEndpoint:          fSTSEndpoint,
+	}
+}
+
+// temporary credentials are renewed this long before they expire, so long runs never sign with stale keys
+func expiryWindow(d time.Duration) time.Duration {
+	window := d / 4
+	if window > time.Minute {
+		window = time.Minute
+	}
+	return window
+}
+
+// Builds the credentials for settings on top of sess, nil when the session's own chain applies.
+// Temporary credentials refresh themselves when they near expiry. STS calls go through stsClient,
+// which must not be wrapped by wrapHTTPTransport: --record-http would write the credentials to disk.
+func newCredentials(sess *session.Session, settings CredentialSettings, stsClient *http.Client) (*credentials.Credentials, error) {
+	var base *credentials.Credentials
+
+	switch {
+	case settings.CredentialProcess != "" && settings.AccessKey != "":
+		return nil, fmt.Errorf("use either --credential-process or --access-key, not both")
+	case settings.CredentialProcess != "":
+		base = processcreds.NewCredentials(settings.CredentialProcess, func(p *processcreds.ProcessProvider) {
+			p.ExpiryWindow = expiryWindow(p.Duration)
+		})
+	case settings.AccessKey != "":
+		if settings.SecretKey == "" {
+			return nil, fmt.Errorf("--access-key needs --secret-key")
+		}
+		base = credentials.NewStaticCredentials(settings.AccessKey, settings.SecretKey, settings.SessionToken)
+	}
+
+	if settings.RoleARN == "" {
+		if settings.WebIdentityTokenFile != "" || settings.ExternalID != "" {
+			return nil, fmt.Errorf("--web-identity-token-file and --external-id need --role-arn")
+		}
+		return base, nil
+	}
+
+	//STS never goes to the S3 --endpoint-url, only to --sts-endpoint or the regional default
+	stsConfig := &aws.Config{Endpoint: aws.String(settings.STSEndpoint), HTTPClient: stsClient}
+	if aws.StringValue(sess.Config.Region) == "" {
+		stsConfig.Region = aws.String("us-east-1")
+	}
+	sessionName := settings.RoleSessionName
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("pS3-%d", time.Now().Unix())
+	}
+
+	if settings.WebIdentityTokenFile != "" {
+		//the token is the credential, the call itself is unsigned
+		stsConfig.Credentials = credentials.AnonymousCredentials
+		provider := stscreds.NewWebIdentityRoleProviderWithOptions(sts.New(sess, stsConfig), settings.RoleARN, sessionName,
+			stscreds.FetchTokenPath(settings.WebIdentityTokenFile), func(p *stscreds.WebIdentityRoleProvider) {
+				p.Duration = settings.RoleDuration
+				p.ExpiryWindow = expiryWindow(settings.RoleDuration)
+			})
+		logger.Info("assuming role with web identity", "role", settings.RoleARN, "token_file", settings.WebIdentityTokenFile)
+		return credentials.NewCredentials(provider), nil
+	}
+
+	if base != nil {
+		stsConfig.Credentials = base
+	}
+	logger.Info("assuming role", "role", settings.RoleARN, "session", sessionName, "duration", settings.RoleDuration)
+	return stscreds.NewCredentialsWithClient(sts.New(sess, stsConfig), settings.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = sessionName
+		p.Duration = settings.RoleDuration
+		p.ExpiryWindow = expiryWindow(settings.RoleDuration)
+		if settings.ExternalID != "" {
+			p.ExternalID = aws.String(settings.ExternalID)
+		}
+	}), nil
+}
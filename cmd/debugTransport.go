@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugTransport logs one record per exchange once the response body is
+// closed: operation, method, redacted URL and headers, status, request IDs,
+// bytes sent and received, time to headers and total latency.
+type debugTransport struct {
+	next http.RoundTripper
+}
+
+// headers as a sorted "Name: value" list, credentials redacted
+func debugHeaders(h http.Header) []string {
+	var lines []string
+	for name, values := range redactHeader(h) {
+		lines = append(lines, name+": "+strings.Join(values, ","))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := context.Background()
+	if !httpLogger.Enabled(ctx, slog.LevelDebug) {
+		return t.next.RoundTrip(req)
+	}
+
+	attrs := []any{
+		"operation", s3OperationName(req),
+		"method", req.Method,
+		"url", redactURL(req.URL),
+		"request_headers", debugHeaders(req.Header),
+		"bytes_sent", req.ContentLength,
+	}
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		httpLogger.Debug("http exchange failed", append(attrs, "latency", time.Since(start), "error", err)...)
+		return resp, err
+	}
+
+	attrs = append(attrs,
+		"status", resp.StatusCode,
+		"request_id", resp.Header.Get("x-amz-request-id"),
+		"host_id", resp.Header.Get("x-amz-id-2"),
+		"response_headers", debugHeaders(resp.Header),
+		"header_latency", time.Since(start),
+	)
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: func(received int64, readErr error) {
+		attrs = append(attrs, "bytes_received", received, "latency", time.Since(start))
+		if readErr != nil && readErr != io.EOF {
+			attrs = append(attrs, "error", readErr)
+		}
+		httpLogger.Debug("http exchange", attrs...)
+	}}
+	return resp, nil
+}
+
+// countingBody counts the bytes read and calls done once, when it is closed
+type countingBody struct {
+	io.ReadCloser
+	received int64
+	readErr  error
+	once     sync.Once
+	done     func(received int64, readErr error)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.received += int64(n)
+	if err != nil {
+		b.readErr = err
+	}
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.done(b.received, b.readErr) })
+	return err
+}
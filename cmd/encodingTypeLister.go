@@ -0,0 +1,67 @@
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// encodingTypeLister asks S3 for URL encoded keys and decodes them, so keys with
+// characters XML 1.0 cannot carry are listed intact
+type encodingTypeLister struct {
+	s3Lister
+}
+
+// Wraps svc for --encoding-type, "" leaves it as is
+func withEncodingType(svc s3Lister, encodingType string) (s3Lister, error) {
+	switch encodingType {
+	case "":
+		return svc, nil
+	case s3.EncodingTypeUrl:
+		return encodingTypeLister{svc}, nil
+	}
+	return nil, fmt.Errorf("unknown encoding type %q, use url", encodingType)
+}
+
+func (l encodingTypeLister) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	params := *input
+	params.EncodingType = aws.String(s3.EncodingTypeUrl)
+	resp, err := l.s3Lister.ListObjectsV2(&params)
+	if err != nil {
+		return nil, err
+	}
+	//a server that ignores the parameter returns the keys as they are
+	if aws.StringValue(resp.EncodingType) != s3.EncodingTypeUrl {
+		return resp, nil
+	}
+
+	decode := func(s *string) error {
+		if s == nil {
+			return nil
+		}
+		decoded, err := url.QueryUnescape(*s)
+		if err != nil {
+			return fmt.Errorf("decoding %q: %w", *s, err)
+		}
+		*s = decoded
+		return nil
+	}
+	for _, field := range []*string{resp.Prefix, resp.StartAfter, resp.Delimiter} {
+		if err := decode(field); err != nil {
+			return nil, err
+		}
+	}
+	for _, object := range resp.Contents {
+		if err := decode(object.Key); err != nil {
+			return nil, err
+		}
+	}
+	for _, prefix := range resp.CommonPrefixes {
+		if err := decode(prefix.Prefix); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
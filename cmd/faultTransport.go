@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// faultRule holds the injection rates, from 0 to 1, for one operation
+type faultRule struct {
+	slowDown    float64 //503 SlowDown
+	internal    float64 //500 InternalError
+	reset       float64 //connection reset before a response
+	truncate    float64 //response body cut short
+	latency     float64
+	latencyTime time.Duration
+}
+
+// faultTransport wraps a RoundTripper and randomly fails requests
+type faultTransport struct {
+	next  http.RoundTripper
+	rules map[string]*faultRule //by operation name, "*" applies to operations without their own rule
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+// Parses an --inject-faults specification of the form
+//
+//	[operation:]fault=rate[,fault=rate...][;[operation:]...]
+//
+// where fault is one of 503, 500, reset, truncate or latency, and latency takes
+// a duration as rate@duration, e.g. "503=0.05,latency=0.1@500ms;ListObjectsV2:truncate=0.02"
+func parseFaultSpec(spec string) (map[string]*faultRule, error) {
+	rules := make(map[string]*faultRule)
+
+	for _, group := range strings.Split(spec, ";") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		op := "*"
+		if i := strings.Index(group, ":"); i >= 0 {
+			op, group = strings.TrimSpace(group[:i]), group[i+1:]
+		}
+
+		rule := &faultRule{}
+		for _, item := range strings.Split(group, ",") {
+			name, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+			if !ok {
+				return nil, fmt.Errorf("fault %q is not of the form fault=rate", item)
+			}
+			rateStr, durStr, hasDur := strings.Cut(value, "@")
+			rate, err := strconv.ParseFloat(rateStr, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return nil, fmt.Errorf("fault %q rate must be between 0 and 1", item)
+			}
+
+			switch name {
+			case "503":
+				rule.slowDown = rate
+			case "500":
+				rule.internal = rate
+			case "reset":
+				rule.reset = rate
+			case "truncate":
+				rule.truncate = rate
+			case "latency":
+				if !hasDur {
+					return nil, fmt.Errorf("fault %q needs a duration, e.g. latency=0.1@200ms", item)
+				}
+				d, err := time.ParseDuration(durStr)
+				if err != nil {
+					return nil, fmt.Errorf("fault %q: %w", item, err)
+				}
+				rule.latency, rule.latencyTime = rate, d
+			default:
+				return nil, fmt.Errorf("unknown fault %q, expected 503, 500, reset, truncate or latency", name)
+			}
+		}
+		if rule.slowDown+rule.internal+rule.reset+rule.truncate > 1 {
+			return nil, fmt.Errorf("fault rates for %s add up to more than 1", op)
+		}
+		rules[op] = rule
+	}
+
+	return rules, nil
+}
+
+func newFaultTransport(next http.RoundTripper, spec string, seed int64) (*faultTransport, error) {
+	rules, err := parseFaultSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	logger.Warn("injecting faults", "spec", spec, "seed", seed)
+
+	return &faultTransport{
+		next:  next,
+		rules: rules,
+		rnd:   rand.New(rand.NewSource(seed)),
+	}, nil
+}
+
+func (t *faultTransport) roll() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rnd.Float64()
+}
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := s3OperationName(req)
+	rule, ok := t.rules[op]
+	if !ok {
+		if rule, ok = t.rules["*"]; !ok {
+			return t.next.RoundTrip(req)
+		}
+	}
+
+	if rule.latency > 0 && t.roll() < rule.latency {
+		logTrace("fault injected", "fault", "latency", "latency", rule.latencyTime, "operation", op, "url", req.URL.String())
+		select {
+		case <-time.After(rule.latencyTime):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	//a single roll picks at most one failure
+	r := t.roll()
+	switch {
+	case r < rule.slowDown:
+		logTrace("fault injected", "fault", "503", "operation", op, "url", req.URL.String())
+		return faultResponse(req, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate."), nil
+	case r < rule.slowDown+rule.internal:
+		logTrace("fault injected", "fault", "500", "operation", op, "url", req.URL.String())
+		return faultResponse(req, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."), nil
+	case r < rule.slowDown+rule.internal+rule.reset:
+		logTrace("fault injected", "fault", "reset", "operation", op, "url", req.URL.String())
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+	case r < rule.slowDown+rule.internal+rule.reset+rule.truncate:
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || resp.Body == nil || resp.ContentLength == 0 {
+			return resp, err
+		}
+		logTrace("fault injected", "fault", "truncate", "operation", op, "url", req.URL.String())
+		resp.Body = &truncatedBody{body: resp.Body, remaining: resp.ContentLength / 2}
+		return resp, nil
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+// builds an S3 XML error response without sending the request
+func faultResponse(req *http.Request, status int, code string, message string) *http.Response {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	body := fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message><RequestId>pS3-injected</RequestId></Error>`, code, message)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/xml"}, "X-Amz-Request-Id": {"pS3-injected"}},
+		Body:          io.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// truncatedBody returns io.ErrUnexpectedEOF once remaining bytes have been read.
+// When the length is unknown the body fails on the first read.
+type truncatedBody struct {
+	body      io.ReadCloser
+	remaining int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.body.Read(p)
+	b.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (b *truncatedBody) Close() error {
+	return b.body.Close()
+}
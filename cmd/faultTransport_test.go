@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFaultSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]faultRule
+	}{
+		{"", map[string]faultRule{}},
+		{"503=0.05", map[string]faultRule{"*": {slowDown: 0.05}}},
+		{
+			"503=0.05,500=0.01,reset=0.02,truncate=0.03,latency=0.1@500ms",
+			map[string]faultRule{"*": {slowDown: 0.05, internal: 0.01, reset: 0.02, truncate: 0.03, latency: 0.1, latencyTime: 500 * time.Millisecond}},
+		},
+		{
+			" 503=0.05 ; ListObjectsV2: truncate=0.02 ;",
+			map[string]faultRule{"*": {slowDown: 0.05}, "ListObjectsV2": {truncate: 0.02}},
+		},
+		{"PutObject:503=1", map[string]faultRule{"PutObject": {slowDown: 1}}},
+		{"latency=1@2s", map[string]faultRule{"*": {latency: 1, latencyTime: 2 * time.Second}}},
+	}
+	for _, tt := range tests {
+		rules, err := parseFaultSpec(tt.spec)
+		if err != nil {
+			t.Errorf("parseFaultSpec(%q): %v", tt.spec, err)
+			continue
+		}
+		if len(rules) != len(tt.want) {
+			t.Errorf("parseFaultSpec(%q) = %d rules, want %d", tt.spec, len(rules), len(tt.want))
+		}
+		for op, want := range tt.want {
+			if got := rules[op]; got == nil || *got != want {
+				t.Errorf("parseFaultSpec(%q)[%q] = %+v, want %+v", tt.spec, op, got, want)
+			}
+		}
+	}
+}
+
+func TestParseFaultSpecErrors(t *testing.T) {
+	tests := []struct {
+		spec string
+		want string
+	}{
+		{"503", "not of the form"},
+		{"503=x", "between 0 and 1"},
+		{"503=1.5", "between 0 and 1"},
+		{"503=-0.1", "between 0 and 1"},
+		{"latency=0.1", "needs a duration"},
+		{"latency=0.1@soon", "latency=0.1@soon"},
+		{"404=0.1", "unknown fault"},
+		{"GetObject:503=0.6,reset=0.5", "GetObject add up to more than 1"},
+	}
+	for _, tt := range tests {
+		_, err := parseFaultSpec(tt.spec)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseFaultSpec(%q) error = %v, want %q", tt.spec, err, tt.want)
+		}
+	}
+}
@@ -1,29 +1,152 @@
 package cmd
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
 )
 
-// util to output Debug information to stdout
-func VerbosePrintln(str ...interface{}) {
-	if fVerbose || fDebug || fTrace {
-		log.Println(str...)
-		return
+// LevelTrace is below slog.LevelDebug, for per request and per prefix detail
+const LevelTrace = slog.Level(-8)
+
+// structured logger for progress and diagnostics, errors that end the run still go to stderr through log
+var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+// logger for --debug-http, at debug level or below
+var httpLogger = logger
+
+var logLevels = map[string]slog.Level{
+	"trace": LevelTrace,
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// util to log at trace level
+func logTrace(msg string, args ...any) {
+	logger.Log(context.Background(), LevelTrace, msg, args...)
+}
+
+// Replaces logger with one for --log-level, --log-format and --log-file.
+// Without --log-level, --verbose, --debug and --trace select info, debug and trace.
+func initLogging() error {
+	level := slog.LevelWarn
+	switch {
+	case fLogLevel != "":
+		l, ok := logLevels[strings.ToLower(fLogLevel)]
+		if !ok {
+			return fmt.Errorf("unknown log level %q, use trace, debug, info, warn or error", fLogLevel)
+		}
+		level = l
+	case fTrace:
+		level = LevelTrace
+	case fDebug:
+		level = slog.LevelDebug
+	case fVerbose:
+		level = slog.LevelInfo
+	}
+
+	var w io.Writer = os.Stderr
+	if fLogFile != "" {
+		maxSize, err := parseByteSize(fLogMaxSize)
+		if err != nil {
+			return fmt.Errorf("--log-max-size: %w", err)
+		}
+		rf, err := newRotatingFile(fLogFile, maxSize, fLogMaxFiles)
+		if err != nil {
+			return err
+		}
+		w = rf
+	}
+
+	if fLogFormat != "text" && fLogFormat != "json" {
+		return fmt.Errorf("unknown log format %q, use text or json", fLogFormat)
+	}
+	newLogger := func(level slog.Level) *slog.Logger {
+		opts := &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.LevelKey && a.Value.Any().(slog.Level) == LevelTrace {
+					a.Value = slog.StringValue("TRACE")
+				}
+				return a
+			},
+		}
+		if fLogFormat == "json" {
+			return slog.New(slog.NewJSONHandler(w, opts))
+		}
+		return slog.New(slog.NewTextHandler(w, opts))
 	}
+
+	logger = newLogger(level)
+	//--debug-http shows its exchanges whatever the level of the other messages
+	httpLogger = logger
+	if fDebugHTTP && level > slog.LevelDebug {
+		httpLogger = newLogger(slog.LevelDebug)
+	}
+	return nil
+}
+
+// rotatingFile is a log file that is renamed to name.1 (name.1 to name.2 and so on,
+// up to maxFiles old files) once it grows past maxSize bytes.
+type rotatingFile struct {
+	mu       sync.Mutex
+	name     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func newRotatingFile(name string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{name: name, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
 }
 
-// util to output Debug information to stdout
-func DebugPrintln(str ...interface{}) {
-	if fDebug || fTrace {
-		log.Println(str...)
-		return
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+	}
+	if r.maxFiles > 0 {
+		os.Rename(r.name, r.name+".1")
+	} else {
+		os.Remove(r.name)
 	}
+	return r.open()
 }
 
-// util to output Trace information to stdout
-func TracePrintln(str ...interface{}) {
-	if fTrace {
-		log.Println(str...)
-		return
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
 	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
 }
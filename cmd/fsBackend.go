@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// prefix used on --bucket to select a local or NFS directory instead of an S3 bucket
+const localBucketScheme = "file://"
+
+// fsEntry is one regular file of a local bucket
+type fsEntry struct {
+	key          string
+	path         string
+	size         int64
+	lastModified time.Time
+
+	etagMu sync.Mutex
+	etag   string
+}
+
+// fsBackend serves the listing engine from a POSIX directory tree, relative paths are used as keys
+type fsBackend struct {
+	root        string
+	computeETag bool
+	entries     []*fsEntry //sorted by key
+	keys        []string   //same order as entries
+}
+
+// returns the directory for a file:// bucket name
+func localBucketRoot(bucketName string) (string, bool) {
+	if !strings.HasPrefix(bucketName, localBucketScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(bucketName, localBucketScheme), true
+}
+
+// Walks root once and indexes every regular file as an object
+func newFSBackend(root string, computeETag bool) (*fsBackend, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	b := &fsBackend{root: root, computeETag: computeETag}
+
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			//unreadable sub directories are skipped rather than failing the whole listing
+			logger.Debug("skipping file", "path", path, "error", err)
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			logger.Debug("skipping file", "path", path, "error", err)
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		b.entries = append(b.entries, &fsEntry{
+			key:          filepath.ToSlash(rel),
+			path:         path,
+			size:         fi.Size(),
+			lastModified: fi.ModTime().UTC(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	//S3 lists keys in UTF-8 binary order which differs from the per directory walk order
+	sort.Slice(b.entries, func(i, j int) bool { return b.entries[i].key < b.entries[j].key })
+	b.keys = make([]string, len(b.entries))
+	for i, e := range b.entries {
+		b.keys[i] = e.key
+	}
+
+	logTrace("local bucket indexed", "bucket", root, "files", len(b.entries))
+	return b, nil
+}
+
+// ListObjectsV2 implements s3Lister for a local directory tree
+func (b *fsBackend) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	prefix := aws.StringValue(input.Prefix)
+	delimiter := aws.StringValue(input.Delimiter)
+	maxKeys := aws.Int64Value(input.MaxKeys)
+	if input.MaxKeys == nil {
+		maxKeys = 1000
+	}
+
+	startAfter := aws.StringValue(input.StartAfter)
+	if input.ContinuationToken != nil {
+		token, err := base64.StdEncoding.DecodeString(*input.ContinuationToken)
+		if err != nil {
+			return nil, fmt.Errorf("invalid continuation token: %w", err)
+		}
+		startAfter = string(token)
+	}
+
+	page := listSortedKeys(b.keys, prefix, startAfter, delimiter, maxKeys)
+
+	out := &s3.ListObjectsV2Output{
+		Name:        input.Bucket,
+		Prefix:      input.Prefix,
+		Delimiter:   input.Delimiter,
+		MaxKeys:     aws.Int64(maxKeys),
+		StartAfter:  input.StartAfter,
+		IsTruncated: aws.Bool(page.truncated),
+		KeyCount:    aws.Int64(int64(len(page.indexes) + len(page.commonPrefixes))),
+	}
+	if input.ContinuationToken != nil {
+		out.ContinuationToken = input.ContinuationToken
+	}
+	if page.truncated {
+		out.NextContinuationToken = aws.String(base64.StdEncoding.EncodeToString([]byte(page.next)))
+	}
+
+	for _, i := range page.indexes {
+		out.Contents = append(out.Contents, b.object(b.entries[i]))
+	}
+	for _, p := range page.commonPrefixes {
+		out.CommonPrefixes = append(out.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(p)})
+	}
+
+	return out, nil
+}
+
+func (b *fsBackend) object(e *fsEntry) *s3.Object {
+	obj := &s3.Object{
+		Key:          aws.String(e.key),
+		Size:         aws.Int64(e.size),
+		LastModified: aws.Time(e.lastModified),
+		StorageClass: aws.String(s3.ObjectStorageClassStandard),
+	}
+	if b.computeETag {
+		obj.ETag = aws.String(e.md5ETag())
+	}
+	return obj
+}
+
+// md5 of the file contents in S3 single part ETag form, computed once per file. A file
+// that cannot be read has no ETag and is read again the next time.
+func (e *fsEntry) md5ETag() string {
+	e.etagMu.Lock()
+	defer e.etagMu.Unlock()
+	if e.etag != "" {
+		return e.etag
+	}
+
+	f, err := os.Open(e.path)
+	if err != nil {
+		logger.Warn("etag failed", "path", e.path, "error", err)
+		return ""
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		logger.Warn("etag failed", "path", e.path, "error", err)
+		return ""
+	}
+	e.etag = `"` + hex.EncodeToString(h.Sum(nil)) + `"`
+	return e.etag
+}
+
+// keyPage is one page of a listing over a sorted key slice
+type keyPage struct {
+	indexes        []int
+	commonPrefixes []string
+	truncated      bool
+	next           string //last key or common prefix returned, listing resumes after it
+}
+
+// Applies ListObjects prefix, start-after, delimiter and max-keys semantics to sorted keys
+func listSortedKeys(keys []string, prefix string, startAfter string, delimiter string, maxKeys int64) keyPage {
+	var page keyPage
+	//S3 answers max-keys=0 with an empty page that is not truncated
+	if maxKeys == 0 {
+		return page
+	}
+
+	start := prefix
+	if startAfter > start {
+		start = startAfter
+	}
+	i := sort.SearchStrings(keys, start)
+
+	var count int64
+	lastWasPrefix := false
+	for ; i < len(keys); i++ {
+		key := keys[i]
+		if key <= startAfter {
+			continue
+		}
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+
+		if delimiter != "" {
+			if d := strings.Index(key[len(prefix):], delimiter); d >= 0 {
+				cp := key[:len(prefix)+d+len(delimiter)]
+				if len(page.commonPrefixes) > 0 && page.commonPrefixes[len(page.commonPrefixes)-1] == cp {
+					continue
+				}
+				if count == maxKeys {
+					page.truncated = true
+					break
+				}
+				page.commonPrefixes = append(page.commonPrefixes, cp)
+				page.next = cp
+				lastWasPrefix = true
+				count++
+				continue
+			}
+		}
+
+		if count == maxKeys {
+			page.truncated = true
+			break
+		}
+		page.indexes = append(page.indexes, i)
+		page.next = key
+		lastWasPrefix = false
+		count++
+	}
+
+	//a common prefix is resumed after all of the keys it rolls up
+	if page.truncated && lastWasPrefix {
+		page.next += "\U0010FFFF"
+	}
+
+	return page
+}
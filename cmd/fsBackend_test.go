@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestListSortedKeys(t *testing.T) {
+	keys := []string{"a-b", "a/b", "a/c/d", "a/c/e", "a0", "b", "c/x", "é"}
+	tests := []struct {
+		name                      string
+		prefix, startAfter, delim string
+		maxKeys                   int64
+		want, wantPrefixes        []string
+		wantTruncated             bool
+		wantNext                  string
+	}{
+		{name: "all", maxKeys: 1000, want: keys},
+		{name: "max-keys 0", maxKeys: 0},
+		{name: "truncated", maxKeys: 2, want: []string{"a-b", "a/b"}, wantTruncated: true, wantNext: "a/b"},
+		{name: "prefix", prefix: "a/", maxKeys: 1000, want: []string{"a/b", "a/c/d", "a/c/e"}},
+		{name: "start after", startAfter: "a/c/d", maxKeys: 1000, want: []string{"a/c/e", "a0", "b", "c/x", "é"}},
+		{name: "start after below prefix", prefix: "c", startAfter: "a", maxKeys: 1000, want: []string{"c/x"}},
+		{name: "delimiter", delim: "/", maxKeys: 1000, want: []string{"a-b", "a0", "b", "é"}, wantPrefixes: []string{"a/", "c/"}},
+		{name: "delimiter under prefix", prefix: "a/", delim: "/", maxKeys: 1000, want: []string{"a/b"}, wantPrefixes: []string{"a/c/"}},
+		{
+			name: "truncated on a common prefix", delim: "/", maxKeys: 2,
+			want: []string{"a-b"}, wantPrefixes: []string{"a/"}, wantTruncated: true, wantNext: "a/\U0010FFFF",
+		},
+	}
+	for _, tt := range tests {
+		page := listSortedKeys(keys, tt.prefix, tt.startAfter, tt.delim, tt.maxKeys)
+		var got []string
+		for _, i := range page.indexes {
+			got = append(got, keys[i])
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: keys %q, want %q", tt.name, got, tt.want)
+		}
+		if strings.Join(page.commonPrefixes, ",") != strings.Join(tt.wantPrefixes, ",") {
+			t.Errorf("%s: common prefixes %q, want %q", tt.name, page.commonPrefixes, tt.wantPrefixes)
+		}
+		if page.truncated != tt.wantTruncated {
+			t.Errorf("%s: truncated %v, want %v", tt.name, page.truncated, tt.wantTruncated)
+		}
+		if tt.wantTruncated && page.next != tt.wantNext {
+			t.Errorf("%s: next %q, want %q", tt.name, page.next, tt.wantNext)
+		}
+	}
+}
+
+// Keys come back in S3 byte order, not in directory walk order
+func TestFSBackendKeyOrder(t *testing.T) {
+	root := t.TempDir()
+	//a directory walk visits a/ before a-b and a/b/ before a/b-c
+	for _, name := range []string{"a/b/c", "a/b-c", "a-b", "a0", "A", "é"} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := newFSBackend(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	input := &s3.ListObjectsV2Input{MaxKeys: aws.Int64(2)}
+	for {
+		resp, err := b.ListObjectsV2(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range resp.Contents {
+			got = append(got, *o.Key)
+			if aws.StringValue(o.ETag) == "" {
+				t.Errorf("no ETag for %s", *o.Key)
+			}
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		input.ContinuationToken = resp.NextContinuationToken
+	}
+	want := []string{"A", "a-b", "a/b-c", "a/b/c", "a0", "é"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("listed %q, want %q", got, want)
+	}
+}
+
+// A file that cannot be read is hashed again once it can
+func TestMD5ETagRetriesFailures(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	e := &fsEntry{key: "f", path: path}
+	if got := e.md5ETag(); got != "" {
+		t.Fatalf("ETag of a missing file = %q", got)
+	}
+	if err := os.WriteFile(path, []byte("hi\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := `"764efa883dda1e11db47671c4a3bbd9e"`
+	if got := e.md5ETag(); got != want {
+		t.Errorf("ETag = %s, want %s", got, want)
+	}
+	os.Remove(path)
+	if got := e.md5ETag(); got != want {
+		t.Errorf("ETag once computed = %s, want %s", got, want)
+	}
+}
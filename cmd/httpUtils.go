@@ -1,11 +1,18 @@
 package cmd
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/request"
 	"golang.org/x/net/http2"
 )
 
@@ -16,36 +23,273 @@ type HTTPClientSettings struct {
 	IdleConn              time.Duration
 	MaxAllIdleConns       int
 	MaxHostIdleConns      int
+	MaxHostConns          int
 	ResponseHeader        time.Duration
 	TLSHandshake          time.Duration
 	TLSInsecureSkipVerify bool
+	ForceHTTP1            bool
+
+	//PEM files, and the minimum TLS version as "1.2"
+	CABundle      string
+	ClientCert    string
+	ClientKey     string
+	TLSMinVersion string
+
+	//addresses to spread connections to EndpointURL's host over, see addressPool
+	EndpointURL       string
+	EndpointAddresses []string
+	EndpointBalance   string
+
+	//testing only, see parseFaultSpec
+	InjectFaults     string
+	InjectFaultsSeed int64
+
+	//directories to capture exchanges to, or to answer requests from instead of the network
+	RecordHTTP string
+	ReplayHTTP string
+
+	//log every exchange, see debugTransport
+	DebugHTTP bool
+}
+
+// Returns the client settings selected by the persistent flags and config file
+func httpClientSettingsFromFlags() HTTPClientSettings {
+	return HTTPClientSettings{
+		Connect:               fConnectTimeout,
+		ExpectContinue:        fExpectContinueTimeout,
+		IdleConn:              fIdleConnTimeout,
+		ConnKeepAlive:         fKeepAlive,
+		MaxAllIdleConns:       fMaxIdleConns,
+		MaxHostIdleConns:      fMaxIdleConnsPerHost, // This setting is important for concurrent HEAD requests
+		MaxHostConns:          fMaxConnsPerHost,
+		ResponseHeader:        fResponseHeaderTimeout,
+		TLSHandshake:          fTLSHandshakeTimeout,
+		TLSInsecureSkipVerify: fNoVerifySSL,
+		ForceHTTP1:            fHTTP1Only,
+		CABundle:              fCABundle,
+		ClientCert:            fClientCert,
+		ClientKey:             fClientKey,
+		TLSMinVersion:         fTLSMinVersion,
+		EndpointURL:           fEndpointUrl,
+		EndpointAddresses:     fEndpointAddresses,
+		EndpointBalance:       fEndpointBalance,
+		InjectFaults:          fInjectFaults,
+		InjectFaultsSeed:      fInjectFaultsSeed,
+		RecordHTTP:            fRecordHTTP,
+		ReplayHTTP:            fReplayHTTP,
+		DebugHTTP:             fDebugHTTP,
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Builds the TLS configuration for the CA bundle, client certificate and version settings
+func newTLSConfig(httpSettings HTTPClientSettings) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: httpSettings.TLSInsecureSkipVerify}
+
+	if httpSettings.TLSMinVersion != "" {
+		version, ok := tlsVersions[httpSettings.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q, use 1.0, 1.1, 1.2 or 1.3", httpSettings.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if httpSettings.CABundle != "" {
+		pem, err := os.ReadFile(httpSettings.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("CA bundle: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s: no PEM certificates found", httpSettings.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if (httpSettings.ClientCert == "") != (httpSettings.ClientKey == "") {
+		return nil, fmt.Errorf("client certificate and key must be given together")
+	}
+	if httpSettings.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(httpSettings.ClientCert, httpSettings.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
 }
 
 func NewHTTPClientWithSettings(httpSettings HTTPClientSettings) (*http.Client, error) {
 	var client http.Client
+	tlsConfig, err := newTLSConfig(httpSettings)
+	if err != nil {
+		return &client, err
+	}
+	dialer := &net.Dialer{
+		KeepAlive: httpSettings.ConnKeepAlive,
+		DualStack: true,
+		Timeout:   httpSettings.Connect,
+	}
+	dialContext := dialer.DialContext
+	if len(httpSettings.EndpointAddresses) > 0 {
+		endpoint, err := url.Parse(httpSettings.EndpointURL)
+		if err != nil {
+			return &client, err
+		}
+		pool, err := newAddressPool(endpoint.Hostname(), httpSettings.EndpointAddresses, httpSettings.EndpointBalance, dialer)
+		if err != nil {
+			return &client, err
+		}
+		dialContext = pool.DialContext
+	}
+
 	tr := &http.Transport{
-		TLSClientConfig:       &tls.Config{InsecureSkipVerify: httpSettings.TLSInsecureSkipVerify},
+		TLSClientConfig:       tlsConfig,
 		ResponseHeaderTimeout: httpSettings.ResponseHeader,
 		Proxy:                 http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			KeepAlive: httpSettings.ConnKeepAlive,
-			DualStack: true,
-			Timeout:   httpSettings.Connect,
-		}).DialContext,
+		DialContext:           dialContext,
 		MaxIdleConns:          httpSettings.MaxAllIdleConns,
 		IdleConnTimeout:       httpSettings.IdleConn,
 		TLSHandshakeTimeout:   httpSettings.TLSHandshake,
 		MaxIdleConnsPerHost:   httpSettings.MaxHostIdleConns,
+		MaxConnsPerHost:       httpSettings.MaxHostConns,
 		ExpectContinueTimeout: httpSettings.ExpectContinue,
 	}
 
-	// So client makes HTTP/2 requests
-	err := http2.ConfigureTransport(tr)
-	if err != nil {
-		return &client, err
+	forceHTTP1 := httpSettings.ForceHTTP1
+	if len(httpSettings.EndpointAddresses) > 0 && !forceHTTP1 {
+		// HTTP/2 would multiplex every request over one connection to one address
+		logger.Info("HTTP/2 disabled, --endpoint-addresses spreads HTTP/1.1 connections", "addresses", len(httpSettings.EndpointAddresses))
+		forceHTTP1 = true
+	}
+	if forceHTTP1 {
+		// A non-nil empty map stops the transport from negotiating HTTP/2
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else {
+		// So client makes HTTP/2 requests
+		err = http2.ConfigureTransport(tr)
+		if err != nil {
+			return &client, err
+		}
 	}
 
 	return &http.Client{
 		Transport: tr,
 	}, nil
 }
+
+// Adds the RoundTripper wrappers selected in httpSettings to a client from
+// NewHTTPClientWithSettings. The SDK only accepts a bare *http.Transport when
+// it applies AWS_CA_BUNDLE, so this must run after the session is created.
+func wrapHTTPTransport(client *http.Client, httpSettings HTTPClientSettings) error {
+	if httpSettings.ReplayHTTP != "" {
+		rt, err := newReplayTransport(httpSettings.ReplayHTTP)
+		if err != nil {
+			return err
+		}
+		client.Transport = rt
+	}
+	if httpSettings.InjectFaults != "" {
+		ft, err := newFaultTransport(client.Transport, httpSettings.InjectFaults, httpSettings.InjectFaultsSeed)
+		if err != nil {
+			return err
+		}
+		client.Transport = ft
+	}
+	if httpSettings.DebugHTTP {
+		client.Transport = &debugTransport{next: client.Transport}
+	}
+	if stats != nil {
+		client.Transport = &statsTransport{next: client.Transport}
+	}
+	//outermost so the capture holds exactly what the SDK saw
+	if httpSettings.RecordHTTP != "" {
+		rt, err := newRecordTransport(client.Transport, httpSettings.RecordHTTP)
+		if err != nil {
+			return err
+		}
+		client.Transport = rt
+	}
+	return nil
+}
+
+// context key holding the S3 API operation name of an outgoing request
+type s3OperationKey struct{}
+
+// SDK send handler that tags each HTTP request with its operation name for the
+// transport wrappers
+func tagS3Operation(r *request.Request) {
+	if r.Operation == nil {
+		return
+	}
+	r.HTTPRequest = r.HTTPRequest.WithContext(context.WithValue(r.HTTPRequest.Context(), s3OperationKey{}, r.Operation.Name))
+}
+
+// Returns the S3 operation of a request, guessed from the method and query
+// string when the request was not made through an SDK session
+func s3OperationName(req *http.Request) string {
+	if name, ok := req.Context().Value(s3OperationKey{}).(string); ok {
+		return name
+	}
+
+	q := req.URL.Query()
+	hasKey := strings.Count(strings.Trim(req.URL.Path, "/"), "/") > 0
+	switch req.Method {
+	case http.MethodGet:
+		switch {
+		case q.Has("location"):
+			return "GetBucketLocation"
+		case q.Has("versions"):
+			return "ListObjectVersions"
+		case q.Has("uploads"):
+			return "ListMultipartUploads"
+		case q.Get("list-type") == "2":
+			return "ListObjectsV2"
+		case hasKey:
+			return "GetObject"
+		case req.URL.Path == "" || req.URL.Path == "/":
+			return "ListBuckets"
+		}
+		return "ListObjects"
+	case http.MethodHead:
+		if hasKey {
+			return "HeadObject"
+		}
+		return "HeadBucket"
+	case http.MethodPut:
+		switch {
+		case q.Has("uploadId"):
+			return "UploadPart"
+		case req.Header.Get("x-amz-copy-source") != "":
+			return "CopyObject"
+		case hasKey:
+			return "PutObject"
+		}
+		return "CreateBucket"
+	case http.MethodPost:
+		switch {
+		case q.Has("uploads"):
+			return "CreateMultipartUpload"
+		case q.Has("uploadId"):
+			return "CompleteMultipartUpload"
+		case q.Has("delete"):
+			return "DeleteObjects"
+		}
+	case http.MethodDelete:
+		switch {
+		case q.Has("uploadId"):
+			return "AbortMultipartUpload"
+		case hasKey:
+			return "DeleteObject"
+		}
+		return "DeleteBucket"
+	}
+	return req.Method
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keyGenerator returns the i-th key of a synthetic keyspace. Keys only depend
+// on i and the seed so they can be regenerated by later phases and workers.
+type keyGenerator func(i int) string
+
+// named key shapes and the template each one expands to
+var keyShapes = map[string]string{
+	"sequential": "{seq:12}",
+	"uuid":       "{uuid}",
+	"date":       "{date:2006/01/02/15}/{uuid}",
+	"skewed":     "{skew:90}/{uuid}",
+	"unicode":    "{unicode}/{unicode}/{uuid}",
+}
+
+// help text for key templates
+const keyTemplateHelp = `Key templates mix literal text with placeholders:
+  {seq} {seq:W}       object index, zero padded to W digits
+  {uuid}              random UUID
+  {date} {date:FMT}   random hour of 2023, Go time layout, default 2006/01/02
+  {rand:N} {hex:N}    N random lowercase alphanumeric or hex characters
+  {pick:a|b|c}        one of the listed values
+  {skew:P}            "hot" for P percent of keys, else one of cold00..cold99
+  {unicode}           a multi-byte word`
+
+// words used to build multi-byte keys
+var unicodeWords = []string{"données", "日本語", "файл", "εικόνα", "数据", "ملف", "데이터", "😀", "naïve café", "straße"}
+
+// splitmix64, a cheap deterministic mix of the seed and index
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// uuid formatted random hex derived from seed and i
+func syntheticUUID(seed int64, i int) string {
+	a := mix64(uint64(seed) ^ uint64(i)<<1)
+	b := mix64(a ^ uint64(i))
+	return fmt.Sprintf("%08x-%04x-4%03x-%04x-%012x", a>>32, (a>>16)&0xffff, a&0xfff, (b>>48)&0x3fff|0x8000, b&0xffffffffffff)
+}
+
+// names of the key shapes, for help and errors
+func keyShapeNames() []string {
+	var names []string
+	for name := range keyShapes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Builds a generator from a shape name or a key template
+func newKeyGenerator(pattern string, seed int64) (keyGenerator, error) {
+	if template, ok := keyShapes[pattern]; ok {
+		pattern = template
+	}
+
+	//each placeholder draws from its own stream so they vary independently
+	type part func(i int, r uint64) string
+	var parts []part
+
+	for rest := pattern; rest != ""; {
+		open := strings.Index(rest, "{")
+		if open < 0 {
+			lit := rest
+			parts = append(parts, func(int, uint64) string { return lit })
+			break
+		}
+		if open > 0 {
+			lit := rest[:open]
+			parts = append(parts, func(int, uint64) string { return lit })
+		}
+		end := strings.Index(rest[open:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated '{' in key template %q", pattern)
+		}
+		p, err := keyPlaceholder(rest[open+1:open+end], seed)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+		rest = rest[open+end+1:]
+	}
+
+	return func(i int) string {
+		var sb strings.Builder
+		for n, p := range parts {
+			sb.WriteString(p(i, mix64(uint64(seed)^mix64(uint64(i))^uint64(n)<<56)))
+		}
+		return sb.String()
+	}, nil
+}
+
+const alphanumeric = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// random characters from charset, drawing more bits from r as needed
+func randomChars(r uint64, n int, charset string) string {
+	b := make([]byte, n)
+	for j := range b {
+		if j%8 == 0 && j > 0 {
+			r = mix64(r)
+		}
+		b[j] = charset[(r>>(8*(j%8)))%uint64(len(charset))]
+	}
+	return string(b)
+}
+
+func keyPlaceholder(spec string, seed int64) (func(i int, r uint64) string, error) {
+	name, arg, hasArg := strings.Cut(spec, ":")
+
+	//origin of {date}, dates are spread over the hours of 2023
+	origin := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	intArg := func() (int, error) {
+		n, err := strconv.Atoi(arg)
+		if !hasArg || err != nil || n < 1 {
+			return 0, fmt.Errorf("key placeholder {%s} needs a positive number, e.g. {%s:8}", spec, name)
+		}
+		return n, nil
+	}
+
+	switch name {
+	case "seq":
+		width := 0
+		if hasArg {
+			w, err := intArg()
+			if err != nil {
+				return nil, err
+			}
+			width = w
+		}
+		return func(i int, _ uint64) string { return fmt.Sprintf("%0*d", width, i) }, nil
+	case "uuid":
+		return func(i int, _ uint64) string { return syntheticUUID(seed, i) }, nil
+	case "date":
+		layout := "2006/01/02"
+		if hasArg {
+			layout = arg
+		}
+		return func(_ int, r uint64) string {
+			return origin.Add(time.Duration(r%(365*24)) * time.Hour).Format(layout)
+		}, nil
+	case "rand", "hex":
+		n, err := intArg()
+		if err != nil {
+			return nil, err
+		}
+		charset := alphanumeric
+		if name == "hex" {
+			charset = "0123456789abcdef"
+		}
+		return func(_ int, r uint64) string { return randomChars(r, n, charset) }, nil
+	case "pick":
+		choices := strings.Split(arg, "|")
+		if !hasArg || arg == "" {
+			return nil, fmt.Errorf("key placeholder {%s} needs values, e.g. {pick:a|b|c}", spec)
+		}
+		return func(_ int, r uint64) string { return choices[r%uint64(len(choices))] }, nil
+	case "skew":
+		pct, err := intArg()
+		if err != nil || pct > 100 {
+			return nil, fmt.Errorf("key placeholder {%s} needs a percentage, e.g. {skew:90}", spec)
+		}
+		return func(_ int, r uint64) string {
+			if int(r%100) < pct {
+				return "hot"
+			}
+			return fmt.Sprintf("cold%02d", (r/100)%100)
+		}, nil
+	case "unicode":
+		return func(_ int, r uint64) string { return unicodeWords[r%uint64(len(unicodeWords))] }, nil
+	}
+	return nil, fmt.Errorf("unknown key placeholder {%s}", spec)
+}
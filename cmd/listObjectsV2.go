@@ -5,12 +5,19 @@ This file is part of CLI application pS3.
 package cmd
 
 import (
+	"bytes"
 	"fmt"
+	"log"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/spf13/cobra"
@@ -20,11 +27,22 @@ import (
 var listObjectsV2Cmd = &cobra.Command{
 	Use:   "list-objects-v2",
 	Short: "Returns some or all of the objects in a bucket.",
-	Long:  `To use this action you must have permissions to perform the s3:ListBucket action.`,
+	Long: `To use this action you must have permissions to perform the s3:ListBucket action.
+
+` + objectTemplateHelp,
 	Run: func(cmd *cobra.Command, args []string) {
 		fBucketName, _ := cmd.Flags().GetString("bucket")
-		fPrefixCount, _ := cmd.Flags().GetInt("prefix-count")
-		listObjectsV2(fBucketName, fPrefixCount, fEndpointUrl, fProfile, fRegion, fNoVerifySSL, fOutput)
+		fPrefixCount, _ := cmd.Flags().GetString("prefix-count")
+		fComputeETag, _ := cmd.Flags().GetBool("compute-etag")
+		fStats, _ := cmd.Flags().GetBool("stats")
+		fStatsFile, _ := cmd.Flags().GetString("stats-file")
+		fPlan, _ := cmd.Flags().GetString("plan")
+		fSavePlan, _ := cmd.Flags().GetString("save-plan")
+		fPrint0, _ := cmd.Flags().GetBool("print0")
+		fEscape, _ := cmd.Flags().GetBool("escape")
+		fEncodingType, _ := cmd.Flags().GetString("encoding-type")
+		fFormat, _ := cmd.Flags().GetString("format")
+		listObjectsV2(fBucketName, fPrefixCount, fComputeETag, fStats, fStatsFile, fPlan, fSavePlan, fPrint0, fEscape, fEncodingType, fFormat, fEndpointUrl, fProfile, fRegion, fNoVerifySSL, fOutput)
 	},
 }
 
@@ -40,36 +58,153 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// listObjectsV2Cmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-	listObjectsV2Cmd.Flags().String("bucket", "", "Bucket name to list (required)")
+	listObjectsV2Cmd.Flags().String("bucket", "", "Bucket name to list, or file:///path to list a local or NFS directory (required)")
 	listObjectsV2Cmd.MarkFlagRequired("bucket")
-	listObjectsV2Cmd.Flags().Int("prefix-count", 500, "Prefix count for distribution calculation. The number is the point where prefixes above 1000 objects are passed for processing.")
+	listObjectsV2Cmd.Flags().String("prefix-count", "500", "Prefix count for distribution calculation. The number is the point where prefixes above 1000 objects are passed for processing. auto samples the bucket and picks the discovery depth for the --workers.")
+	listObjectsV2Cmd.Flags().Bool("compute-etag", false, "Compute MD5 ETags when listing a file:// bucket.")
+	listObjectsV2Cmd.Flags().Bool("stats", false, "Print API calls, retries, latencies, bytes, prefix discovery and phase timings to stderr at the end of the run.")
+	listObjectsV2Cmd.Flags().String("stats-file", "", "Write the end of run statistics as JSON to this file.")
+	listObjectsV2Cmd.Flags().String("save-plan", "", "Write the prefixes listed and their object counts to this file, for --plan.")
+	listObjectsV2Cmd.Flags().Bool("print0", false, "Print only the keys, each followed by a NUL character, for xargs -0.")
+	listObjectsV2Cmd.Flags().Bool("escape", false, "Print C-style escapes for backslashes, control and non printable characters in keys, so every object is one line.")
+	listObjectsV2Cmd.Flags().String("format", "", "Print each object with a Go template, e.g. '{{.Key}}\\t{{.Size | human}}', see the fields and functions above.")
+	listObjectsV2Cmd.Flags().String("encoding-type", "", "Set to url to have S3 URL encode the keys it returns, needed for keys with characters XML cannot carry. Keys are decoded before output.")
+	listObjectsV2Cmd.Flags().String("plan", "", "Skip prefix discovery and list the prefixes of a --save-plan file. Objects added outside the planned prefixes are still found.")
+
+}
 
+// s3Lister is the part of the S3 API used by the listing engine, it is
+// satisfied by *s3.S3 and by the local filesystem backend
+type s3Lister interface {
+	ListObjectsV2(*s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error)
 }
 
-func listObjectsV2(fBucketName string, fPrefixCount int, fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool, fOutput string) {
+func listObjectsV2(fBucketName string, fPrefixCount string, fComputeETag bool, fStats bool, fStatsFile string, fPlan string, fSavePlan string, fPrint0 bool, fEscape bool, fEncodingType string, fFormat string, fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool, fOutput string) {
+
+	logTrace("list-objects-v2", "bucket", fBucketName, "endpoint", fEndpointUrl, "profile", fProfile, "region", fRegion, "no_verify_ssl", fNoVerifySSL, "output", fOutput, "prefix_count", fPrefixCount)
+
+	prefixCount, autoPrefixCount, err := parsePrefixCount(fPrefixCount)
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+	if fStats || fStatsFile != "" {
+		stats = newRunStats()
+	}
+	var plan *prefixPlan
+	if fPlan != "" {
+		p, err := loadPlan(fPlan, fBucketName)
+		if err != nil {
+			log.Fatalln("error: plan:", err)
+		}
+		plan = p
+		logger.Info("listing from plan", "bucket", fBucketName, "plan", fPlan, "created", plan.Created, "prefixes", len(plan.Prefixes), "objects", plan.Objects)
+	}
+	svc, urlBase := newListingService(fBucketName, fComputeETag, fEncodingType, fEndpointUrl, fProfile, fRegion, fNoVerifySSL)
+
+	//a plan is listed without discovery, the plan saved from it keeps the count it was saved with
+	if autoPrefixCount && plan != nil {
+		prefixCount = plan.PrefixCount
+		if prefixCount == 0 {
+			prefixCount = 500
+		}
+		autoPrefixCount = false
+	}
+
+	encode, err := objectEncoderFor(fPrint0, fEscape, fFormat, fBucketName, urlBase)
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+
+	//variables / structures for object processing
+	chs3Object := make(chan []*s3.Object, objectBatchQueue)
+	var prefixes []keyRange
+	//sync waitgroup
+	var wg sync.WaitGroup
 
-	TracePrintln("trace: list-objects-v2 bucket: ", fBucketName, "endpoint: ", fEndpointUrl, "profile: ", fProfile, "region: ", fRegion, "no_ssl: ", fNoVerifySSL, "output: ", fOutput, "prefix-count: ", fPrefixCount)
+	staleGaps := 0
+	go func() {
+		endPhase := stats.phase("discovery")
+		if fPlan != "" || fSavePlan != "" {
+			planRecorder = newPrefixPlan(fBucketName, prefixCount)
+		}
+		if plan != nil {
+			prefixes, staleGaps = listPlan(svc, fBucketName, plan, chs3Object, fDebug)
+		} else {
+			svc = discoverBucket(svc, fBucketName, prefixCount, autoPrefixCount, chs3Object, &wg, &prefixes, fDebug)
+		}
+		wg.Wait()
+		endPhase()
+		endPhase = stats.phase("parallel_listing")
+		listObjectsInParallel(svc, fBucketName, prefixes, chs3Object, &wg, fDebug)
+		wg.Wait()
+		endPhase()
+		close(chs3Object)
+	}()
+	readObjectsV2(fOutput, encode, chs3Object)
+
+	if plan != nil {
+		checkPlanStale(fBucketName, plan, staleGaps, fSavePlan)
+	}
+	if fSavePlan != "" {
+		if err := planRecorder.save(fSavePlan); err != nil {
+			log.Fatalln("error: save plan:", err)
+		}
+		logger.Info("plan saved", "bucket", fBucketName, "plan", fSavePlan, "prefixes", len(planRecorder.Prefixes), "objects", planRecorder.Objects)
+	}
+	if err := stats.write(os.Stderr, fStats, fStatsFile); err != nil {
+		log.Fatalln("error: stats:", err)
+	}
+
+}
+
+// Returns the lister of a bucket, the local backend for file:// buckets, and the start
+// of the object URLs, empty for local buckets
+func newListingService(fBucketName string, fComputeETag bool, fEncodingType string, fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool) (s3Lister, string) {
+	if root, ok := localBucketRoot(fBucketName); ok {
+		fsb, err := newFSBackend(root, fComputeETag)
+		if err != nil {
+			log.Fatalln("error: local bucket", root, ":", err)
+		}
+		return fsb, ""
+	}
+	s3svc := newS3Service(fBucketName, fEndpointUrl, fProfile, fRegion, fNoVerifySSL)
+	svc, err := withEncodingType(s3svc, fEncodingType)
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+	return svc, objectURLBase(s3svc, fBucketName)
+}
+
+// Builds an S3 client for the bucket's region
+func newS3Service(fBucketName string, fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool) *s3.S3 {
+
+	clients := regionClientsFor(fEndpointUrl, fProfile, fRegion, fNoVerifySSL)
+	svc := clients.forBucket(fBucketName)
+
+	if !aws.BoolValue(svc.Config.S3ForcePathStyle) && !virtualHostCompatible(svc.Endpoint, fBucketName) {
+		logger.Info("bucket cannot be a host name, using path style", "bucket", fBucketName, "endpoint", svc.Endpoint)
+	}
+	return svc
+}
+
+// Builds the SDK session shared by the S3 clients of a command
+func newS3Session(fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool) *session.Session {
 
 	//build s3 api session
-	httpClient, err := NewHTTPClientWithSettings(HTTPClientSettings{
-		Connect:               5 * time.Second,
-		ExpectContinue:        1 * time.Second,
-		IdleConn:              30 * time.Second, //90
-		ConnKeepAlive:         10 * time.Second, //30
-		MaxAllIdleConns:       100,
-		MaxHostIdleConns:      100, // This setting is important for concurrent HEAD requests
-		ResponseHeader:        5 * time.Second,
-		TLSHandshake:          5 * time.Second,
-		TLSInsecureSkipVerify: fNoVerifySSL,
-	})
+	httpSettings := httpClientSettingsFromFlags()
+	httpClient, err := NewHTTPClientWithSettings(httpSettings)
 	if err != nil {
 		log.Fatalf("Error creating custom HTTP client: %v\n", err)
 		//os.Exit(1) called implicitly by log.Fatalf
 	}
 
+	pathStyle, err := usePathStyle(fAddressingStyle, fEndpointUrl)
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+
 	s3Config := &aws.Config{
-		DisableSSL:       aws.Bool(fNoVerifySSL),
-		S3ForcePathStyle: aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(pathStyle),
 		HTTPClient:       httpClient,
 		//Region:           aws.String("us-east-1"),
 		//Credentials:      credentials.NewSharedCredentials("", fProfile),
@@ -87,7 +222,12 @@ func listObjectsV2(fBucketName string, fPrefixCount int, fEndpointUrl string, fP
 		s3Config.Region = &fRegion
 	}
 
-	sess, err := session.NewSessionWithOptions(session.Options{
+	//replayed captures are redacted, requests only need to be signable
+	if fReplayHTTP != "" {
+		s3Config.Credentials = credentials.NewStaticCredentials("replay", "replay", "")
+	}
+
+	opts := session.Options{
 		// Specify profile to load for the session's config
 		Profile: fProfile,
 
@@ -96,120 +236,153 @@ func listObjectsV2(fBucketName string, fPrefixCount int, fEndpointUrl string, fP
 
 		// Force enable Shared Config support
 		SharedConfigState: session.SharedConfigEnable,
-	})
+	}
 
-	if err != nil {
-		log.Fatalln("error: S3 session creation failed")
+	//the client already trusts --ca-bundle, handing it to the SDK as well stops AWS_CA_BUNDLE replacing it
+	if httpSettings.CABundle != "" {
+		pem, err := os.ReadFile(httpSettings.CABundle)
+		if err != nil {
+			log.Fatalln("error: CA bundle:", err)
+		}
+		opts.CustomCABundle = bytes.NewReader(pem)
 	}
 
-	svc := s3.New(sess)
+	sess, err := session.NewSessionWithOptions(opts)
 
-	location, err := getBucketLocation(svc, fBucketName)
 	if err != nil {
-		DebugPrintln("Error getting location for bucket or endpoint does not have a 'region'", fBucketName, ":", err)
+		log.Fatalln("error: S3 session creation failed:", err)
 	}
-
-	if location != fRegion {
-		TracePrintln("trace: bucket region is: ", location)
-		s3Config.Region = aws.String(location)
-	} else {
-		s3Config.Region = aws.String("us-west-1")
+	if err := wrapHTTPTransport(httpClient, httpSettings); err != nil {
+		log.Fatalf("Error creating custom HTTP client: %v\n", err)
 	}
-
-	sess, err = session.NewSessionWithOptions(session.Options{
-		// Specify profile to load for the session's config
-		Profile: fProfile,
-
-		// Provide SDK Config options, such as Region.
-		Config: *s3Config,
-
-		// Force enable Shared Config support
-		SharedConfigState: session.SharedConfigEnable,
-	})
-	if err != nil {
-		log.Fatalln("error: S3 session creation failed")
+	sess.Handlers.Send.PushFront(tagS3Operation)
+	if stats != nil {
+		sess.Config.Retryer = statsRetryer{client.DefaultRetryer{NumMaxRetries: client.DefaultRetryerMaxNumRetries}}
 	}
 
-	svc = s3.New(sess)
-
-	//variables / structures for object processing
-	chs3Object := make(chan *s3.Object)
-	done := make(chan bool)
-	var prefixes []string
-	//sync waitgroup
-	var wg sync.WaitGroup
+	switch fSignatureVersion {
+	case "v4", "v2":
+	default:
+		log.Fatalln("error: unknown signature version", fSignatureVersion, ", use v4 or v2")
+	}
 
-	go func() {
-		findPrefixes(svc, fBucketName, "", fPrefixCount, chs3Object, &wg, &prefixes, fDebug)
-		wg.Wait()
-		listObjectsInParallel(svc, fBucketName, prefixes, chs3Object, &wg, fDebug)
-		wg.Wait()
-		close(chs3Object)
-		done <- true
-	}()
-	readObjectsV2(fOutput, chs3Object, done)
+	if fNoSignRequest {
+		sess.Config.Credentials = credentials.AnonymousCredentials
+	} else if fReplayHTTP == "" {
+		//STS gets a bare client of its own, the wrapped one records and logs exchanges
+		stsSettings := httpSettings
+		stsSettings.EndpointAddresses = nil
+		stsClient, err := NewHTTPClientWithSettings(stsSettings)
+		if err != nil {
+			log.Fatalf("Error creating custom HTTP client: %v\n", err)
+		}
+		creds, err := newCredentials(sess, credentialSettingsFromFlags(), stsClient)
+		if err != nil {
+			log.Fatalln("error: credentials:", err)
+		}
+		if creds != nil {
+			sess.Config.Credentials = creds
+		}
+	}
 
+	return sess
 }
 
-
-func readObjectsV2(fOutput string, ch3Object <-chan *s3.Object, done <-chan bool) {
-        var wg sync.WaitGroup
-	numWorkers := maxSemaphore
-	var objCount int32 = 0 //int32 for atomic operations
-
-	//worker function
-	worker := func() {
-		defer wg.Done()
-		for item := range ch3Object {
-			if fDebug || fTrace {
-				atomic.AddInt32(&objCount, 1)
-				} else {
-				fmt.Printf("Object: %v \t %d \t %s\n", *item.LastModified, *item.Size, *item.Key)
-				}
-			}
+// Decides between path style and virtual-hosted requests for --addressing-style
+func usePathStyle(fAddressingStyle string, fEndpointUrl string) (bool, error) {
+	switch fAddressingStyle {
+	case "path":
+		return true, nil
+	case "virtual":
+		//bucket sub domains of an IP address do not exist
+		if u, err := url.Parse(fEndpointUrl); err == nil && net.ParseIP(u.Hostname()) != nil {
+			logger.Info("endpoint is an IP address, using path style", "endpoint", fEndpointUrl)
+			return true, nil
 		}
+		return false, nil
+	case "auto":
+		//custom endpoints seldom have wildcard DNS and certificates for bucket sub domains
+		return fEndpointUrl != "", nil
+	}
+	return false, fmt.Errorf("unknown addressing style %q, use path, virtual or auto", fAddressingStyle)
+}
 
-	//start workers
-	wg.Add(numWorkers)
-	for i := 0; i< numWorkers; i++ {
-		go worker()
-		}
+var dnsBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+var ipBucketName = regexp.MustCompile(`^(\d+\.){3}\d+$`)
 
-	//wait for done signal
-	<-done
+// Reports whether bucket can be the leading label of the endpoint host name. Over https
+// dots are excluded since a wildcard certificate only matches one label, the SDK then
+// falls back to path style.
+func virtualHostCompatible(endpoint string, bucket string) bool {
+	if strings.HasPrefix(endpoint, "https://") && strings.Contains(bucket, ".") {
+		return false
+	}
+	return dnsBucketName.MatchString(bucket) && !ipBucketName.MatchString(bucket) && !strings.Contains(bucket, "..")
+}
 
-	//wait for workes to complete
-	wg.Wait()
+func readObjectsV2(fOutput string, encode objectEncoder, chs3Object <-chan []*s3.Object) {
+	objects, err := writeObjects(os.Stdout, chs3Object, encode)
+	if err != nil {
+		log.Fatalln("error: writing output:", err)
+	}
+	logger.Info("objects listed", "objects", objects)
+}
 
-	//debug print the objectCount
-	if fDebug || fTrace {
-		fmt.Println("debug: item count=". atomic.LoadInt32(&objCount))
+// Finds the prefixes to list in parallel, listing the small ones on the way, and returns the
+// lister to list them with. A local bucket holds its keys sorted in memory and is listed whole,
+// probing it would skip the names with characters discovery does not try.
+func discoverBucket(svc s3Lister, fBucketName string, prefixCount int, autoPrefixCount bool, chs3Object chan<- []*s3.Object, wg *sync.WaitGroup, prefixes *[]keyRange, fDebug bool) s3Lister {
+	if _, ok := svc.(*fsBackend); ok {
+		*prefixes = []keyRange{{}}
+		return svc
+	}
+	depth := 0
+	if autoPrefixCount {
+		svc, prefixCount, depth = tunePrefixCount(svc, fBucketName, maxSemaphore)
+		if planRecorder != nil {
+			planRecorder.PrefixCount = prefixCount
 		}
+	}
+	findPrefixes(svc, fBucketName, "", prefixCount, depth, chs3Object, wg, prefixes, fDebug)
+	return svc
 }
 
-func findPrefixes(svc *s3.S3, fBucketName, prefix string, target int, chs3Object chan<- *s3.Object, wg *sync.WaitGroup, prefixes *[]string, fDebug bool) {
+// Probes the prefixes under prefix and lists the small ones. Large ones are discovered further
+// until target prefixes have been found, or with depth set until they are depth characters
+// longer than prefix, and are then left in prefixes for listObjectsInParallel. A large prefix
+// that is also a key, already listed, is left to be listed after it. The keys under the probed
+// prefixes whose next character is none of characters are left in prefixes as sweep ranges.
+func findPrefixes(svc s3Lister, fBucketName, prefix string, target int, depth int, chs3Object chan<- []*s3.Object, wg *sync.WaitGroup, prefixes *[]keyRange, fDebug bool) {
 
 	var mu sync.Mutex
 	var processedCount int
+	var sweeps []keyRange
 
-	var discoverPrefixes func(string)
-	discoverPrefixes = func(currentPrefix string) {
+	var discoverPrefixes func(string, bool)
+	discoverPrefixes = func(currentPrefix string, isKey bool) {
 		defer wg.Done()
 
 		mu.Lock()
 		thisProcessedCount := processedCount
 		thislenPrefixes := len(*prefixes)
 		mu.Unlock()
-		TracePrintln("trace: processed small prefixes processed: ", thisProcessedCount, " 'large' prefixes discoverd: ", thislenPrefixes)
+		logTrace("prefix discovery", "bucket", fBucketName, "small_prefixes", thisProcessedCount, "large_prefixes", thislenPrefixes)
 
-		if thisProcessedCount >= target {
-			TracePrintln("trace: prefix overload", currentPrefix)
+		if (depth == 0 && thisProcessedCount >= target) || (depth > 0 && len(currentPrefix)-len(prefix) >= depth) {
+			logTrace("prefix overload", "bucket", fBucketName, "prefix", currentPrefix)
 
+			r := keyRange{prefix: currentPrefix}
+			if isKey {
+				r.from = currentPrefix + "\x00"
+			}
 			mu.Lock()
-			*prefixes = append(*prefixes, currentPrefix)
+			*prefixes = append(*prefixes, r)
 			mu.Unlock()
 			return
 		}
+		mu.Lock()
+		sweeps = append(sweeps, sweepRanges(currentPrefix)...)
+		mu.Unlock()
 		for _, c := range characters {
 			nextPrefix := currentPrefix + c
 
@@ -220,14 +393,18 @@ func findPrefixes(svc *s3.S3, fBucketName, prefix string, target int, chs3Object
 			}
 
 			objectCount := len(resp.Contents)
+			stats.add("probe_lists", 1)
 
 			if objectCount > 999 {
+				stats.add("probe_lists_large", 1)
 
-				if nextPrefix == *resp.Contents[0].Key {
+				isKey := nextPrefix == *resp.Contents[0].Key
+				if isKey {
 					//unique key with prefix found
-					TracePrintln("trace: 'single' prefix=key: ", prefix)
+					logTrace("prefix is a key", "bucket", fBucketName, "prefix", prefix)
 
-					chs3Object <- resp.Contents[0]
+					chs3Object <- resp.Contents[:1]
+					planRecorder.add(nextPrefix, 1, true)
 
 				}
 
@@ -235,10 +412,10 @@ func findPrefixes(svc *s3.S3, fBucketName, prefix string, target int, chs3Object
 				processedCount++
 				thisProcessedCount := processedCount
 				mu.Unlock()
-				TracePrintln("trace: current discovered 'large' prefix count at ", thisProcessedCount)
+				logTrace("large prefix discovered", "bucket", fBucketName, "count", thisProcessedCount)
 
 				wg.Add(1)
-				go discoverPrefixes(nextPrefix)
+				go discoverPrefixes(nextPrefix, isKey)
 
 			} else if objectCount > 0 {
 
@@ -246,30 +423,33 @@ func findPrefixes(svc *s3.S3, fBucketName, prefix string, target int, chs3Object
 				processedCount++
 				thisProcessedCount := processedCount
 				mu.Unlock()
-				TracePrintln("trace: current processed 'small' prefix count at ", thisProcessedCount)
-				TracePrintln("trace: 'small' prefix: ", nextPrefix, "item count: ", len(resp.Contents))
-
-				for i := range resp.Contents {
-					chs3Object <- resp.Contents[i]
-				}
+				logTrace("small prefix listed", "bucket", fBucketName, "count", thisProcessedCount)
+				logTrace("small prefix", "bucket", fBucketName, "prefix", nextPrefix, "objects", len(resp.Contents))
+				stats.add("small_prefixes", 1)
+				planRecorder.add(nextPrefix, int64(objectCount), false)
+
+				chs3Object <- resp.Contents
+			} else {
+				stats.add("probe_lists_empty", 1)
 			}
 		}
 	}
 
 	wg.Add(1)
-	discoverPrefixes(prefix)
+	discoverPrefixes(prefix, false)
 	wg.Wait()
 
 	//Loop to rebuild prefixes if too low when compared to target count
 	//Loop runs a total 10 times and then we stop so as to not iterate down to zero and make no progress
+	//a depth is the level discovery was meant to stop at
 	prefix_iterate := 0
-	for len(*prefixes) > 0 && prefix_iterate < 10 {
-		DebugPrintln("debug: large prefixes", len(*prefixes), "discovered but target is", target, "re-iterate", prefix_iterate, "/5")
+	for depth == 0 && len(*prefixes) > 0 && prefix_iterate < 10 {
+		logger.Debug("too few large prefixes, re-iterating", "bucket", fBucketName, "prefix", prefix, "prefixes", len(*prefixes), "target", target, "attempt", prefix_iterate)
 
 		if len(*prefixes) < target {
 
 			prefix_iterate++
-			DebugPrintln("debug: prefix count too low ", len(*prefixes))
+			logger.Debug("prefix count too low", "bucket", fBucketName, "prefixes", len(*prefixes))
 
 			mu.Lock()
 			processedCount = processedCount * 3 / 4
@@ -280,48 +460,48 @@ func findPrefixes(svc *s3.S3, fBucketName, prefix string, target int, chs3Object
 
 			for _, p := range oldPrefixes {
 				wg.Add(1)
-				discoverPrefixes(p)
+				discoverPrefixes(p.prefix, p.from != "")
 			}
 		} else {
 			break
 		}
 	}
+	stats.add("large_prefixes_discovered", int64(len(*prefixes)))
+	stats.add("sweep_ranges", int64(len(sweeps)))
+	//mostly empty, one LIST each
+	*prefixes = append(*prefixes, sweeps...)
 }
 
-func listObjectsInParallel(svc *s3.S3, fBucketName string, prefixes []string, chs3Object chan<- *s3.Object, wg *sync.WaitGroup, fDebug bool) {
-	// semaphore defines slots available
-	// using struct{} as lowest memory consumption for just a slot tracker
-	semaphore := make(chan struct{}, maxSemaphore)
-	// Additional channel to signal that all goroutines have been scheduled
-	scheduled := make(chan struct{}, len(prefixes))
-
-	DebugPrintln("debug: Large Prefixes to process", len(prefixes))
-
-	for _, prefix := range prefixes {
-		pcount := 0
-		wg.Add(1)
-		go func(prefix string) {
-			semaphore <- struct{}{}
-			scheduled <- struct{}{}
-
-			defer wg.Done()
-			defer func() {
-				<-semaphore // release a slot
-			}()
+// Returns the ranges of the keys under prefix whose next byte starts none of characters,
+// discovery never probes them
+func sweepRanges(prefix string) []keyRange {
+	var probed [256]bool
+	for _, c := range characters {
+		probed[c[0]] = true
+	}
+	var ranges []keyRange
+	for lo := 0; lo < len(probed); lo++ {
+		if probed[lo] {
+			continue
+		}
+		hi := lo
+		for hi+1 < len(probed) && !probed[hi+1] {
+			hi++
+		}
+		r := keyRange{prefix: prefix, from: prefix + string([]byte{byte(lo)})}
+		if hi+1 < len(probed) {
+			r.before = prefix + string([]byte{byte(hi + 1)})
+		}
+		ranges = append(ranges, r)
+		lo = hi
+	}
+	return ranges
+}
 
-			tcount, err := s3ListAllObjectsWithBackoff(svc, fBucketName, prefix, "", "", 1000, chs3Object)
-			pcount = tcount
+func listObjectsInParallel(svc s3Lister, fBucketName string, prefixes []keyRange, chs3Object chan<- []*s3.Object, wg *sync.WaitGroup, fDebug bool) {
 
-			if err != nil {
-				log.Fatalln("Error listing objects for prefix:", prefix, err)
-				//os.Exit(1) called implicitly by log.Fatal
-			}
-			TracePrintln("trace: 'large' prefix", prefix, "item count: ", pcount)
+	logger.Debug("large prefixes to list", "bucket", fBucketName, "prefixes", len(prefixes))
 
-		}(prefix)
-	}
-	// Wait for all goroutines to be scheduled before waiting for their completion
-	for i := 0; i < len(prefixes); i++ {
-		<-scheduled
-	}
+	//maxSemaphore workers, the ones without a prefix of their own split stragglers
+	newPartitionScheduler(svc, fBucketName, prefixes, chs3Object).run(maxSemaphore)
 }
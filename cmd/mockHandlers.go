@@ -0,0 +1,881 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// mockError is an S3 error response
+type mockError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *mockError) Error() string {
+	return e.code + ": " + e.message
+}
+
+var (
+	errNoSuchBucket     = &mockError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errNoSuchKey        = &mockError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNoSuchVersion    = &mockError{http.StatusNotFound, "NoSuchVersion", "The specified version does not exist."}
+	errNoSuchUpload     = &mockError{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist."}
+	errBucketNotEmpty   = &mockError{http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty"}
+	errMethodNotAllowed = &mockError{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errInvalidPart      = &mockError{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found."}
+	errInvalidArgument  = &mockError{http.StatusBadRequest, "InvalidArgument", "Invalid Argument"}
+	errMalformedXML     = &mockError{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed or did not validate against our published schema."}
+	errNotImplemented   = &mockError{http.StatusNotImplemented, "NotImplemented", "A header you provided implies functionality that is not implemented."}
+	errInvalidToken     = &mockError{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"}
+	errInvalidEncoding  = &mockError{http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request"}
+	errKeyOutsideDir    = &mockError{http.StatusBadRequest, "InvalidArgument", "The key resolves to a path outside the served directory"}
+)
+
+const s3XMLNamespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// XML documents of the S3 REST API served by the mock
+type (
+	mockOwner struct {
+		ID          string `xml:"ID"`
+		DisplayName string `xml:"DisplayName"`
+	}
+
+	mockErrorResult struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string   `xml:"Code"`
+		Message   string   `xml:"Message"`
+		Resource  string   `xml:"Resource"`
+		RequestID string   `xml:"RequestId"`
+	}
+
+	mockBucketEntry struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+
+	mockListAllMyBucketsResult struct {
+		XMLName xml.Name          `xml:"ListAllMyBucketsResult"`
+		Xmlns   string            `xml:"xmlns,attr"`
+		Owner   mockOwner         `xml:"Owner"`
+		Buckets []mockBucketEntry `xml:"Buckets>Bucket"`
+	}
+
+	mockLocationConstraint struct {
+		XMLName  xml.Name `xml:"LocationConstraint"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:",chardata"`
+	}
+
+	mockVersioningConfiguration struct {
+		XMLName xml.Name `xml:"VersioningConfiguration"`
+		Xmlns   string   `xml:"xmlns,attr"`
+	}
+
+	mockContents struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+		StorageClass string `xml:"StorageClass"`
+	}
+
+	mockCommonPrefix struct {
+		Prefix string `xml:"Prefix"`
+	}
+
+	mockListBucketResult struct {
+		XMLName               xml.Name           `xml:"ListBucketResult"`
+		Xmlns                 string             `xml:"xmlns,attr"`
+		Name                  string             `xml:"Name"`
+		Prefix                string             `xml:"Prefix"`
+		Marker                *string            `xml:"Marker,omitempty"`
+		NextMarker            string             `xml:"NextMarker,omitempty"`
+		StartAfter            string             `xml:"StartAfter,omitempty"`
+		ContinuationToken     string             `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string             `xml:"NextContinuationToken,omitempty"`
+		KeyCount              *int               `xml:"KeyCount,omitempty"`
+		MaxKeys               int64              `xml:"MaxKeys"`
+		Delimiter             string             `xml:"Delimiter,omitempty"`
+		EncodingType          string             `xml:"EncodingType,omitempty"`
+		IsTruncated           bool               `xml:"IsTruncated"`
+		Contents              []mockContents     `xml:"Contents"`
+		CommonPrefixes        []mockCommonPrefix `xml:"CommonPrefixes"`
+	}
+
+	mockVersionEntry struct {
+		Key          string `xml:"Key"`
+		VersionID    string `xml:"VersionId"`
+		IsLatest     bool   `xml:"IsLatest"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag,omitempty"`
+		Size         *int64 `xml:"Size,omitempty"`
+		StorageClass string `xml:"StorageClass,omitempty"`
+	}
+
+	mockListVersionsResult struct {
+		XMLName             xml.Name           `xml:"ListVersionsResult"`
+		Xmlns               string             `xml:"xmlns,attr"`
+		Name                string             `xml:"Name"`
+		Prefix              string             `xml:"Prefix"`
+		KeyMarker           string             `xml:"KeyMarker"`
+		VersionIDMarker     string             `xml:"VersionIdMarker"`
+		NextKeyMarker       string             `xml:"NextKeyMarker,omitempty"`
+		NextVersionIDMarker string             `xml:"NextVersionIdMarker,omitempty"`
+		MaxKeys             int64              `xml:"MaxKeys"`
+		IsTruncated         bool               `xml:"IsTruncated"`
+		Versions            []mockVersionEntry `xml:"Version"`
+		DeleteMarkers       []mockVersionEntry `xml:"DeleteMarker"`
+	}
+
+	mockCopyResult struct {
+		XMLName      xml.Name
+		ETag         string `xml:"ETag"`
+		LastModified string `xml:"LastModified"`
+	}
+
+	mockInitiateMultipartUploadResult struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}
+
+	mockCompleteMultipartUpload struct {
+		Parts []struct {
+			PartNumber int64  `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+
+	mockCompleteMultipartUploadResult struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}
+
+	mockUploadEntry struct {
+		Key       string `xml:"Key"`
+		UploadID  string `xml:"UploadId"`
+		Initiated string `xml:"Initiated"`
+	}
+
+	mockListMultipartUploadsResult struct {
+		XMLName     xml.Name          `xml:"ListMultipartUploadsResult"`
+		Xmlns       string            `xml:"xmlns,attr"`
+		Bucket      string            `xml:"Bucket"`
+		IsTruncated bool              `xml:"IsTruncated"`
+		Uploads     []mockUploadEntry `xml:"Upload"`
+	}
+
+	mockDelete struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key       string `xml:"Key"`
+			VersionID string `xml:"VersionId"`
+		} `xml:"Object"`
+	}
+
+	mockDeleted struct {
+		Key                   string `xml:"Key"`
+		VersionID             string `xml:"VersionId,omitempty"`
+		DeleteMarker          bool   `xml:"DeleteMarker,omitempty"`
+		DeleteMarkerVersionID string `xml:"DeleteMarkerVersionId,omitempty"`
+	}
+
+	mockDeleteResult struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Deleted []mockDeleted `xml:"Deleted"`
+	}
+)
+
+// mockS3Handler serves the S3 REST API from a mockStore using path style addressing
+type mockS3Handler struct {
+	store       *mockStore
+	stsDuration time.Duration
+}
+
+// timestamp format used in S3 XML documents
+func mockTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (h *mockS3Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestID := h.store.nextID()
+	w.Header().Set("x-amz-request-id", requestID)
+	w.Header().Set("x-amz-id-2", requestID)
+	w.Header().Set("Server", "pS3-mock")
+
+	logTrace("mock-server request", "method", r.Method, "url", r.URL.String())
+
+	bucketName, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	var err error
+	switch {
+	case bucketName == "" && r.Method == http.MethodPost:
+		err = h.serveSTS(w, r)
+	case bucketName == "":
+		err = h.serveService(w, r)
+	case key == "":
+		err = h.serveBucket(w, r, bucketName)
+	default:
+		err = h.serveObject(w, r, bucketName, key)
+	}
+
+	if err != nil {
+		mErr, ok := err.(*mockError)
+		if !ok {
+			mErr = &mockError{http.StatusInternalServerError, "InternalError", err.Error()}
+		}
+		logger.Debug("mock-server error", "method", r.Method, "url", r.URL.String(), "error", mErr)
+		if r.Method == http.MethodHead {
+			w.WriteHeader(mErr.status)
+			return
+		}
+		writeMockXML(w, mErr.status, mockErrorResult{
+			Code:      mErr.code,
+			Message:   mErr.message,
+			Resource:  r.URL.Path,
+			RequestID: requestID,
+		})
+	}
+}
+
+func writeMockXML(w http.ResponseWriter, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
+
+// ListBuckets
+func (h *mockS3Handler) serveService(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return errMethodNotAllowed
+	}
+	result := mockListAllMyBucketsResult{
+		Xmlns: s3XMLNamespace,
+		Owner: mockOwner{ID: "pS3-mock", DisplayName: "pS3-mock"},
+	}
+	for _, b := range h.store.bucketNames() {
+		result.Buckets = append(result.Buckets, mockBucketEntry{Name: b.name, CreationDate: mockTime(b.created)})
+	}
+	writeMockXML(w, http.StatusOK, result)
+	return nil
+}
+
+func (h *mockS3Handler) serveBucket(w http.ResponseWriter, r *http.Request, bucketName string) error {
+	q := r.URL.Query()
+
+	if r.Method == http.MethodPut {
+		h.store.createBucket(bucketName)
+		w.Header().Set("Location", "/"+bucketName)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if r.Method == http.MethodDelete {
+		if err := h.store.deleteBucket(bucketName); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	b := h.store.bucket(bucketName)
+	if b == nil {
+		return errNoSuchBucket
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("x-amz-bucket-region", h.store.region)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodPost:
+		if _, ok := q["delete"]; ok {
+			return h.deleteObjects(w, r, b)
+		}
+		return errNotImplemented
+	case http.MethodGet:
+		if _, ok := q["location"]; ok {
+			location := h.store.region
+			if location == "us-east-1" {
+				location = ""
+			}
+			writeMockXML(w, http.StatusOK, mockLocationConstraint{Xmlns: s3XMLNamespace, Location: location})
+			return nil
+		}
+		if _, ok := q["versioning"]; ok {
+			writeMockXML(w, http.StatusOK, mockVersioningConfiguration{Xmlns: s3XMLNamespace})
+			return nil
+		}
+		if _, ok := q["versions"]; ok {
+			return h.listObjectVersions(w, r, b)
+		}
+		if _, ok := q["uploads"]; ok {
+			return h.listMultipartUploads(w, b)
+		}
+		if q.Get("list-type") == "2" {
+			return h.listObjectsV2(w, r, b)
+		}
+		return h.listObjects(w, r, b)
+	}
+	return errMethodNotAllowed
+}
+
+// reads max-keys, S3 caps a page at 1000 keys
+func mockMaxKeys(q url.Values) (int64, error) {
+	maxKeys := int64(1000)
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, errInvalidArgument
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	return maxKeys, nil
+}
+
+// fills the Contents and CommonPrefixes of a listing page
+func (h *mockS3Handler) listPage(b *mockBucket, result *mockListBucketResult, keys []string, page keyPage) {
+	for _, i := range page.indexes {
+		v, err := b.get(keys[i], "")
+		if err != nil {
+			//deleted since the key slice was taken
+			continue
+		}
+		result.Contents = append(result.Contents, mockContents{
+			Key:          keys[i],
+			LastModified: mockTime(v.lastModified),
+			ETag:         v.eTag(),
+			Size:         v.size,
+			StorageClass: "STANDARD",
+		})
+	}
+	for _, p := range page.commonPrefixes {
+		result.CommonPrefixes = append(result.CommonPrefixes, mockCommonPrefix{Prefix: p})
+	}
+}
+
+// Applies encoding-type=url to the keys of a listing, which lets S3 return keys XML cannot carry
+func mockEncodeListing(encodingType string, result *mockListBucketResult) error {
+	switch encodingType {
+	case "":
+		return nil
+	case "url":
+	default:
+		return errInvalidEncoding
+	}
+	result.EncodingType = encodingType
+	result.Prefix = url.QueryEscape(result.Prefix)
+	result.StartAfter = url.QueryEscape(result.StartAfter)
+	result.Delimiter = url.QueryEscape(result.Delimiter)
+	result.NextMarker = url.QueryEscape(result.NextMarker)
+	if result.Marker != nil {
+		marker := url.QueryEscape(*result.Marker)
+		result.Marker = &marker
+	}
+	for i := range result.Contents {
+		result.Contents[i].Key = url.QueryEscape(result.Contents[i].Key)
+	}
+	for i := range result.CommonPrefixes {
+		result.CommonPrefixes[i].Prefix = url.QueryEscape(result.CommonPrefixes[i].Prefix)
+	}
+	return nil
+}
+
+func (h *mockS3Handler) listObjectsV2(w http.ResponseWriter, r *http.Request, b *mockBucket) error {
+	q := r.URL.Query()
+	maxKeys, err := mockMaxKeys(q)
+	if err != nil {
+		return err
+	}
+
+	startAfter := q.Get("start-after")
+	if token := q.Get("continuation-token"); token != "" {
+		decoded, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return errInvalidToken
+		}
+		startAfter = string(decoded)
+	}
+
+	keys := b.sortedKeys(true)
+	page := listSortedKeys(keys, q.Get("prefix"), startAfter, q.Get("delimiter"), maxKeys)
+
+	keyCount := len(page.indexes) + len(page.commonPrefixes)
+	result := mockListBucketResult{
+		Xmlns:             s3XMLNamespace,
+		Name:              b.name,
+		Prefix:            q.Get("prefix"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		KeyCount:          &keyCount,
+		MaxKeys:           maxKeys,
+		Delimiter:         q.Get("delimiter"),
+		IsTruncated:       page.truncated,
+	}
+	if page.truncated {
+		result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(page.next))
+	}
+	h.listPage(b, &result, keys, page)
+	if err := mockEncodeListing(q.Get("encoding-type"), &result); err != nil {
+		return err
+	}
+
+	writeMockXML(w, http.StatusOK, result)
+	return nil
+}
+
+func (h *mockS3Handler) listObjects(w http.ResponseWriter, r *http.Request, b *mockBucket) error {
+	q := r.URL.Query()
+	maxKeys, err := mockMaxKeys(q)
+	if err != nil {
+		return err
+	}
+
+	marker := q.Get("marker")
+	keys := b.sortedKeys(true)
+	page := listSortedKeys(keys, q.Get("prefix"), marker, q.Get("delimiter"), maxKeys)
+
+	result := mockListBucketResult{
+		Xmlns:       s3XMLNamespace,
+		Name:        b.name,
+		Prefix:      q.Get("prefix"),
+		Marker:      &marker,
+		MaxKeys:     maxKeys,
+		Delimiter:   q.Get("delimiter"),
+		IsTruncated: page.truncated,
+	}
+	if page.truncated {
+		result.NextMarker = page.next
+	}
+	h.listPage(b, &result, keys, page)
+	if err := mockEncodeListing(q.Get("encoding-type"), &result); err != nil {
+		return err
+	}
+
+	writeMockXML(w, http.StatusOK, result)
+	return nil
+}
+
+func (h *mockS3Handler) listObjectVersions(w http.ResponseWriter, r *http.Request, b *mockBucket) error {
+	q := r.URL.Query()
+	maxKeys, err := mockMaxKeys(q)
+	if err != nil {
+		return err
+	}
+	prefix := q.Get("prefix")
+	keyMarker := q.Get("key-marker")
+	versionIDMarker := q.Get("version-id-marker")
+
+	result := mockListVersionsResult{
+		Xmlns:           s3XMLNamespace,
+		Name:            b.name,
+		Prefix:          prefix,
+		KeyMarker:       keyMarker,
+		VersionIDMarker: versionIDMarker,
+		MaxKeys:         maxKeys,
+	}
+
+	keys := b.sortedKeys(false)
+	var count int64
+	//max-keys=0 gets an empty page that is not truncated, as from S3
+	for i := sort.SearchStrings(keys, prefix); i < len(keys) && !result.IsTruncated && maxKeys > 0; i++ {
+		key := keys[i]
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if key < keyMarker || (key == keyMarker && versionIDMarker == "") {
+			continue
+		}
+
+		versions := b.keyVersions(key)
+		skipping := key == keyMarker
+		for n, v := range versions {
+			if skipping {
+				skipping = v.versionID != versionIDMarker
+				continue
+			}
+			if count == maxKeys {
+				result.IsTruncated = true
+				break
+			}
+			entry := mockVersionEntry{
+				Key:          key,
+				VersionID:    v.versionID,
+				IsLatest:     n == 0,
+				LastModified: mockTime(v.lastModified),
+			}
+			if v.deleteMarker {
+				result.DeleteMarkers = append(result.DeleteMarkers, entry)
+			} else {
+				size := v.size
+				entry.ETag = v.eTag()
+				entry.Size = &size
+				entry.StorageClass = "STANDARD"
+				result.Versions = append(result.Versions, entry)
+			}
+			result.NextKeyMarker = key
+			result.NextVersionIDMarker = v.versionID
+			count++
+		}
+	}
+	if !result.IsTruncated {
+		result.NextKeyMarker = ""
+		result.NextVersionIDMarker = ""
+	}
+
+	writeMockXML(w, http.StatusOK, result)
+	return nil
+}
+
+func (h *mockS3Handler) listMultipartUploads(w http.ResponseWriter, b *mockBucket) error {
+	result := mockListMultipartUploadsResult{Xmlns: s3XMLNamespace, Bucket: b.name}
+
+	b.mu.RLock()
+	for _, u := range b.uploads {
+		result.Uploads = append(result.Uploads, mockUploadEntry{Key: u.key, UploadID: u.id, Initiated: mockTime(u.initiated)})
+	}
+	b.mu.RUnlock()
+	sort.Slice(result.Uploads, func(i, j int) bool { return result.Uploads[i].Key < result.Uploads[j].Key })
+
+	writeMockXML(w, http.StatusOK, result)
+	return nil
+}
+
+func (h *mockS3Handler) deleteObjects(w http.ResponseWriter, r *http.Request, b *mockBucket) error {
+	var req mockDelete
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errMalformedXML
+	}
+
+	result := mockDeleteResult{Xmlns: s3XMLNamespace}
+	for _, o := range req.Objects {
+		v, err := b.remove(o.Key, o.VersionID, h.store.nextID())
+		if err != nil {
+			return err
+		}
+		if req.Quiet {
+			continue
+		}
+		deleted := mockDeleted{Key: o.Key, VersionID: o.VersionID}
+		if v != nil && v.deleteMarker {
+			deleted.DeleteMarker = true
+			deleted.DeleteMarkerVersionID = v.versionID
+		}
+		result.Deleted = append(result.Deleted, deleted)
+	}
+
+	writeMockXML(w, http.StatusOK, result)
+	return nil
+}
+
+func (h *mockS3Handler) serveObject(w http.ResponseWriter, r *http.Request, bucketName string, key string) error {
+	b := h.store.bucket(bucketName)
+	if b == nil {
+		return errNoSuchBucket
+	}
+	q := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		v, err := b.get(key, q.Get("versionId"))
+		if err != nil {
+			return err
+		}
+		return h.getObject(w, r, v)
+
+	case http.MethodPut:
+		if q.Get("uploadId") != "" {
+			return h.uploadPart(w, r, b, key)
+		}
+		if r.Header.Get("x-amz-copy-source") != "" {
+			return h.copyObject(w, r, b, key)
+		}
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return err
+		}
+		v := newMockVersion(h.store.nextID(), data, r.Header.Get("Content-Type"), mockUserMeta(r.Header))
+		if err := b.put(key, v); err != nil {
+			return err
+		}
+		w.Header().Set("ETag", v.eTag())
+		w.Header().Set("x-amz-version-id", v.versionID)
+		w.WriteHeader(http.StatusOK)
+		return nil
+
+	case http.MethodDelete:
+		if id := q.Get("uploadId"); id != "" {
+			b.mu.Lock()
+			_, ok := b.uploads[id]
+			delete(b.uploads, id)
+			b.mu.Unlock()
+			if !ok {
+				return errNoSuchUpload
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+		v, err := b.remove(key, q.Get("versionId"), h.store.nextID())
+		if err != nil {
+			return err
+		}
+		if v != nil {
+			w.Header().Set("x-amz-version-id", v.versionID)
+			if v.deleteMarker {
+				w.Header().Set("x-amz-delete-marker", "true")
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+
+	case http.MethodPost:
+		if _, ok := q["uploads"]; ok {
+			u := &mockUpload{id: h.store.nextID(), key: key, initiated: time.Now().UTC(), parts: make(map[int64]*mockVersion)}
+			b.mu.Lock()
+			b.uploads[u.id] = u
+			b.mu.Unlock()
+			writeMockXML(w, http.StatusOK, mockInitiateMultipartUploadResult{
+				Xmlns:    s3XMLNamespace,
+				Bucket:   b.name,
+				Key:      key,
+				UploadID: u.id,
+			})
+			return nil
+		}
+		if id := q.Get("uploadId"); id != "" {
+			return h.completeMultipartUpload(w, r, b, key, id)
+		}
+		return errNotImplemented
+	}
+	return errMethodNotAllowed
+}
+
+// x-amz-meta-* request headers
+func mockUserMeta(header http.Header) http.Header {
+	meta := http.Header{}
+	for k, v := range header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			meta[k] = v
+		}
+	}
+	return meta
+}
+
+func (h *mockS3Handler) getObject(w http.ResponseWriter, r *http.Request, v *mockVersion) error {
+	header := w.Header()
+	for k, values := range v.meta {
+		header[k] = values
+	}
+	contentType := v.contentType
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.FormatInt(v.size, 10))
+	header.Set("ETag", v.eTag())
+	header.Set("Last-Modified", v.lastModified.Format(http.TimeFormat))
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("x-amz-version-id", v.versionID)
+
+	if r.Method == http.MethodHead {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	body, err := v.open()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	w.WriteHeader(http.StatusOK)
+	io.Copy(w, body)
+	return nil
+}
+
+// resolves an x-amz-copy-source header of the form [/]bucket/key[?versionId=id]
+func (h *mockS3Handler) copySource(r *http.Request) (*mockVersion, error) {
+	source := r.Header.Get("x-amz-copy-source")
+	path, query, _ := strings.Cut(source, "?")
+	path, err := url.PathUnescape(strings.TrimPrefix(path, "/"))
+	if err != nil {
+		return nil, errInvalidArgument
+	}
+	bucketName, key, ok := strings.Cut(path, "/")
+	if !ok || key == "" {
+		return nil, errInvalidArgument
+	}
+	values, _ := url.ParseQuery(query)
+
+	b := h.store.bucket(bucketName)
+	if b == nil {
+		return nil, errNoSuchBucket
+	}
+	return b.get(key, values.Get("versionId"))
+}
+
+func (h *mockS3Handler) copyObject(w http.ResponseWriter, r *http.Request, b *mockBucket, key string) error {
+	src, err := h.copySource(r)
+	if err != nil {
+		return err
+	}
+	data, err := src.bytes()
+	if err != nil {
+		return err
+	}
+
+	contentType, meta := src.contentType, src.meta
+	if strings.EqualFold(r.Header.Get("x-amz-metadata-directive"), "REPLACE") {
+		contentType, meta = r.Header.Get("Content-Type"), mockUserMeta(r.Header)
+	}
+	v := newMockVersion(h.store.nextID(), append([]byte(nil), data...), contentType, meta)
+	if err := b.put(key, v); err != nil {
+		return err
+	}
+
+	w.Header().Set("x-amz-version-id", v.versionID)
+	writeMockXML(w, http.StatusOK, mockCopyResult{
+		XMLName:      xml.Name{Local: "CopyObjectResult"},
+		ETag:         v.eTag(),
+		LastModified: mockTime(v.lastModified),
+	})
+	return nil
+}
+
+func (h *mockS3Handler) uploadPart(w http.ResponseWriter, r *http.Request, b *mockBucket, key string) error {
+	q := r.URL.Query()
+	partNumber, err := strconv.ParseInt(q.Get("partNumber"), 10, 64)
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		return errInvalidArgument
+	}
+
+	b.mu.RLock()
+	u, ok := b.uploads[q.Get("uploadId")]
+	b.mu.RUnlock()
+	if !ok || u.key != key {
+		return errNoSuchUpload
+	}
+
+	var data []byte
+	copying := r.Header.Get("x-amz-copy-source") != ""
+	if copying {
+		src, err := h.copySource(r)
+		if err != nil {
+			return err
+		}
+		if data, err = src.bytes(); err != nil {
+			return err
+		}
+		if rng := r.Header.Get("x-amz-copy-source-range"); rng != "" {
+			var first, last int64
+			if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err != nil || first > last || last >= int64(len(data)) {
+				return &mockError{http.StatusBadRequest, "InvalidRange", "The requested range is not satisfiable"}
+			}
+			data = data[first : last+1]
+		}
+		data = append([]byte(nil), data...)
+	} else if data, err = io.ReadAll(r.Body); err != nil {
+		return err
+	}
+
+	part := newMockVersion("", data, "", nil)
+	b.mu.Lock()
+	u.parts[partNumber] = part
+	b.mu.Unlock()
+
+	if copying {
+		writeMockXML(w, http.StatusOK, mockCopyResult{
+			XMLName:      xml.Name{Local: "CopyPartResult"},
+			ETag:         part.eTag(),
+			LastModified: mockTime(part.lastModified),
+		})
+		return nil
+	}
+	w.Header().Set("ETag", part.eTag())
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (h *mockS3Handler) completeMultipartUpload(w http.ResponseWriter, r *http.Request, b *mockBucket, key string, uploadID string) error {
+	var req mockCompleteMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errMalformedXML
+	}
+
+	if len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	//uploadPart writes the parts under b.mu, the ones listed are copied out under it
+	b.mu.RLock()
+	u, ok := b.uploads[uploadID]
+	var parts []*mockVersion
+	if ok {
+		for _, p := range req.Parts {
+			parts = append(parts, u.parts[p.PartNumber])
+		}
+	}
+	b.mu.RUnlock()
+	if !ok || u.key != key {
+		return errNoSuchUpload
+	}
+
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return &mockError{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order."}
+		}
+		if parts[i] == nil || strings.Trim(parts[i].eTag(), `"`) != strings.Trim(p.ETag, `"`) {
+			return errInvalidPart
+		}
+	}
+
+	v, err := assembleParts(h.store.nextID(), parts)
+	if err != nil {
+		return err
+	}
+
+	//the upload stays until the parts check out, so a client can fix its list and retry
+	b.mu.Lock()
+	_, ok = b.uploads[uploadID]
+	delete(b.uploads, uploadID)
+	b.mu.Unlock()
+	if !ok {
+		return errNoSuchUpload
+	}
+	if err := b.put(key, v); err != nil {
+		return err
+	}
+
+	w.Header().Set("x-amz-version-id", v.versionID)
+	writeMockXML(w, http.StatusOK, mockCompleteMultipartUploadResult{
+		Xmlns:    s3XMLNamespace,
+		Location: "/" + b.name + "/" + key,
+		Bucket:   b.name,
+		Key:      key,
+		ETag:     v.eTag(),
+	})
+	return nil
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const stsXMLNamespace = "https://sts.amazonaws.com/doc/2011-06-15/"
+
+// XML documents of the STS query API served by the mock
+type (
+	mockSTSCredentials struct {
+		AccessKeyID     string `xml:"AccessKeyId"`
+		SecretAccessKey string `xml:"SecretAccessKey"`
+		SessionToken    string `xml:"SessionToken"`
+		Expiration      string `xml:"Expiration"`
+	}
+
+	mockAssumedRoleUser struct {
+		Arn           string `xml:"Arn"`
+		AssumedRoleID string `xml:"AssumedRoleId"`
+	}
+
+	mockAssumeRoleResult struct {
+		XMLName         xml.Name
+		Credentials     mockSTSCredentials  `xml:"Credentials"`
+		AssumedRoleUser mockAssumedRoleUser `xml:"AssumedRoleUser"`
+	}
+
+	mockAssumeRoleResponse struct {
+		XMLName   xml.Name
+		Xmlns     string `xml:"xmlns,attr"`
+		Result    mockAssumeRoleResult
+		RequestID string `xml:"ResponseMetadata>RequestId"`
+	}
+)
+
+// AssumeRole and AssumeRoleWithWebIdentity, POSTed to "/" as a form. Any
+// caller gets credentials valid for DurationSeconds (default 3600), or for
+// --sts-duration which can be shorter than the 15 minutes STS allows.
+func (h *mockS3Handler) serveSTS(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return errInvalidArgument
+	}
+	action := r.PostForm.Get("Action")
+	switch action {
+	case "AssumeRole":
+	case "AssumeRoleWithWebIdentity":
+		if r.PostForm.Get("WebIdentityToken") == "" {
+			return &mockError{http.StatusBadRequest, "InvalidIdentityToken", "WebIdentityToken is empty"}
+		}
+	default:
+		return &mockError{http.StatusBadRequest, "InvalidAction", fmt.Sprintf("unsupported action %q", action)}
+	}
+
+	roleARN := r.PostForm.Get("RoleArn")
+	sessionName := r.PostForm.Get("RoleSessionName")
+	if roleARN == "" || sessionName == "" {
+		return &mockError{http.StatusBadRequest, "ValidationError", "RoleArn and RoleSessionName are required"}
+	}
+	duration := 3600
+	if d := r.PostForm.Get("DurationSeconds"); d != "" {
+		n, err := strconv.Atoi(d)
+		if err != nil || n < 1 {
+			return &mockError{http.StatusBadRequest, "ValidationError", "invalid DurationSeconds"}
+		}
+		duration = n
+	}
+
+	id := h.store.nextID()
+	lifetime := time.Duration(duration) * time.Second
+	if h.stsDuration > 0 {
+		lifetime = h.stsDuration
+	}
+	expiration := time.Now().Add(lifetime)
+	logger.Info("mock-server credentials issued", "operation", action, "role", roleARN, "session", sessionName, "external_id", r.PostForm.Get("ExternalId"), "expires", mockTime(expiration))
+
+	result := mockAssumeRoleResult{
+		XMLName: xml.Name{Local: action + "Result"},
+		Credentials: mockSTSCredentials{
+			AccessKeyID:     "ASIAMOCK" + id,
+			SecretAccessKey: "mock-secret-" + id,
+			SessionToken:    "mock-token-" + id,
+			Expiration:      mockTime(expiration),
+		},
+		AssumedRoleUser: mockAssumedRoleUser{
+			Arn:           roleARN + "/" + sessionName,
+			AssumedRoleID: "AROAMOCK:" + sessionName,
+		},
+	}
+	writeMockXML(w, http.StatusOK, mockAssumeRoleResponse{
+		XMLName:   xml.Name{Local: action + "Response"},
+		Xmlns:     stsXMLNamespace,
+		Result:    result,
+		RequestID: id,
+	})
+	return nil
+}
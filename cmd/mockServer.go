@@ -0,0 +1,165 @@
+/*
+Copyright © 2023 Jean-Baptiste Thomas <jboothomas@gmail.com>
+This file is part of CLI application pS3.
+*/
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// mockServerCmd represents the mock-server command
+var mockServerCmd = &cobra.Command{
+	Use:   "mock-server",
+	Short: "Serves an in-memory S3 endpoint for testing.",
+	Long: `Serves a subset of the S3 REST API (ListObjectsV2/V1, ListObjectVersions, Head/Get/Put/Delete/Copy object,
+multipart uploads, GetBucketLocation) with path style addressing and no authentication. It also answers STS
+AssumeRole and AssumeRoleWithWebIdentity for any role, so --sts-endpoint can point at it.
+
+Objects are kept in memory, or with --dir every sub directory of the given directory is served as a bucket.
+A --seed file holds one key pattern per line, '{1..1000}' expands to a numeric range (zero padded when the
+bounds are, e.g. '{0001..1000}') and '{a,b,c}' to a list of alternatives. Seeded objects are zero bytes.
+
+Point pS3 at it with --endpoint-url http://<listen address>.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fListen, _ := cmd.Flags().GetString("listen")
+		fDir, _ := cmd.Flags().GetString("dir")
+		fSeed, _ := cmd.Flags().GetString("seed")
+		fBucketName, _ := cmd.Flags().GetString("bucket")
+		fSTSDuration, _ := cmd.Flags().GetDuration("sts-duration")
+		mockServer(fListen, fDir, fSeed, fBucketName, fSTSDuration, fRegion)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(mockServerCmd)
+
+	mockServerCmd.Flags().String("listen", "127.0.0.1:9000", "Address to listen on.")
+	mockServerCmd.Flags().String("dir", "", "Serve the sub directories of this directory as buckets, writes go to disk.")
+	mockServerCmd.Flags().String("seed", "", "File of key patterns to create as zero byte objects in --bucket.")
+	mockServerCmd.Flags().String("bucket", "", "Bucket to create and seed (default mock-bucket, with --dir only when it holds no buckets).")
+	mockServerCmd.Flags().Duration("sts-duration", 0, "Lifetime of issued STS credentials, shorter than STS allows to test refresh. 0 uses DurationSeconds.")
+}
+
+func mockServer(fListen string, fDir string, fSeed string, fBucketName string, fSTSDuration time.Duration, fRegion string) {
+
+	logTrace("mock-server", "listen", fListen, "dir", fDir, "seed", fSeed, "bucket", fBucketName, "region", fRegion)
+
+	if fRegion == "" {
+		fRegion = "us-east-1"
+	}
+	store := newMockStore(fRegion, fDir)
+
+	if fDir != "" {
+		if err := store.loadDir(fDir); err != nil {
+			log.Fatalln("error: loading", fDir, ":", err)
+		}
+	}
+
+	//--dir buckets are not joined by an empty directory the user did not ask for
+	if fBucketName == "" && (fDir == "" || fSeed != "" || len(store.bucketNames()) == 0) {
+		fBucketName = "mock-bucket"
+	}
+	if fBucketName != "" {
+		store.createBucket(fBucketName)
+	}
+
+	if fSeed != "" {
+		count, err := seedMockBucket(store, fBucketName, fSeed)
+		if err != nil {
+			log.Fatalln("error: seeding from", fSeed, ":", err)
+		}
+		logger.Info("mock-server seeded", "bucket", fBucketName, "objects", count)
+	}
+
+	fmt.Fprintln(os.Stderr, "mock-server: listening on", fListen)
+	log.Fatalln(http.ListenAndServe(fListen, &mockS3Handler{store: store, stsDuration: fSTSDuration}))
+}
+
+// Creates a zero byte object for every key the pattern file expands to
+func seedMockBucket(store *mockStore, fBucketName string, fSeed string) (int, error) {
+	f, err := os.Open(fSeed)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	b, _ := store.createBucket(fBucketName)
+	count := 0
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimRight(scanner.Text(), "\r")
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+		err := expandKeyPattern(pattern, func(key string) {
+			if err := b.put(key, newMockVersion("null", nil, "", nil)); err != nil {
+				logger.Debug("seeding failed", "key", key, "error", err)
+				return
+			}
+			count++
+		})
+		if err != nil {
+			return count, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	return count, scanner.Err()
+}
+
+// Calls fn for every key of a pattern, expanding {a..b} ranges and {x,y} lists left to right
+func expandKeyPattern(pattern string, fn func(string)) error {
+	open := strings.Index(pattern, "{")
+	if open < 0 {
+		fn(pattern)
+		return nil
+	}
+	end := strings.Index(pattern[open:], "}")
+	if end < 0 {
+		return fmt.Errorf("unterminated '{' in %q", pattern)
+	}
+	end += open
+
+	head, body, tail := pattern[:open], pattern[open+1:end], pattern[end+1:]
+
+	if from, to, ok := strings.Cut(body, ".."); ok {
+		first, err1 := strconv.Atoi(from)
+		last, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil {
+			return fmt.Errorf("invalid range {%s} in %q", body, pattern)
+		}
+		width := 0
+		if (len(from) > 1 && from[0] == '0') || (len(to) > 1 && to[0] == '0') {
+			width = max(len(from), len(to))
+		}
+		step := 1
+		if last < first {
+			step = -1
+		}
+		for i := first; ; i += step {
+			if err := expandKeyPattern(fmt.Sprintf("%s%0*d%s", head, width, i, tail), fn); err != nil {
+				return err
+			}
+			if i == last {
+				break
+			}
+		}
+		return nil
+	}
+
+	for _, alt := range strings.Split(body, ",") {
+		if err := expandKeyPattern(head+alt+tail, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,395 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mockVersion is one stored version of a key, or a delete marker
+type mockVersion struct {
+	versionID    string
+	deleteMarker bool
+	data         []byte
+	path         string //when set the content is read from disk instead of data
+	size         int64
+	etag         string
+	file         *fsEntry //loaded from --dir, the ETag is computed on first use
+	contentType  string
+	meta         http.Header
+	lastModified time.Time
+}
+
+// mockUpload is an in progress multipart upload
+type mockUpload struct {
+	id        string
+	key       string
+	initiated time.Time
+	parts     map[int64]*mockVersion
+}
+
+// mockBucket holds every version of every key, newest version first
+type mockBucket struct {
+	name    string
+	created time.Time
+	dir     string //set when the bucket is backed by a directory
+
+	mu       sync.RWMutex
+	versions map[string][]*mockVersion
+	uploads  map[string]*mockUpload
+	allKeys  []string //sorted keys with any version
+	liveKeys []string //sorted keys whose latest version is not a delete marker
+	dirty    bool
+}
+
+// mockStore is the state of the mock S3 server
+type mockStore struct {
+	region string
+	dir    string
+
+	mu      sync.RWMutex
+	buckets map[string]*mockBucket
+
+	sequence int64
+}
+
+func newMockStore(region string, dir string) *mockStore {
+	return &mockStore{
+		region:  region,
+		dir:     dir,
+		buckets: make(map[string]*mockBucket),
+	}
+}
+
+// unique, increasing ids for versions, uploads and request ids
+func (st *mockStore) nextID() string {
+	return fmt.Sprintf("%016x", atomic.AddInt64(&st.sequence, 1))
+}
+
+func (st *mockStore) bucket(name string) *mockBucket {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.buckets[name]
+}
+
+func (st *mockStore) createBucket(name string) (*mockBucket, bool) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if b, ok := st.buckets[name]; ok {
+		return b, false
+	}
+	b := &mockBucket{
+		name:     name,
+		created:  time.Now().UTC(),
+		versions: make(map[string][]*mockVersion),
+		uploads:  make(map[string]*mockUpload),
+	}
+	if st.dir != "" {
+		b.dir = filepath.Join(st.dir, name)
+		if err := os.MkdirAll(b.dir, 0o755); err != nil {
+			logger.Debug("mock bucket directory", "dir", b.dir, "error", err)
+		}
+	}
+	st.buckets[name] = b
+	return b, true
+}
+
+func (st *mockStore) deleteBucket(name string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	b, ok := st.buckets[name]
+	if !ok {
+		return errNoSuchBucket
+	}
+	b.mu.RLock()
+	empty := len(b.liveKeysLocked()) == 0
+	b.mu.RUnlock()
+	if !empty {
+		return errBucketNotEmpty
+	}
+	if b.dir != "" {
+		os.Remove(b.dir)
+	}
+	delete(st.buckets, name)
+	return nil
+}
+
+func (st *mockStore) bucketNames() []*mockBucket {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+
+	var list []*mockBucket
+	for _, b := range st.buckets {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// Loads every sub directory of dir as a bucket, files are served from disk
+func (st *mockStore) loadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		fsb, err := newFSBackend(filepath.Join(dir, e.Name()), false)
+		if err != nil {
+			return err
+		}
+		b, _ := st.createBucket(e.Name())
+		for _, f := range fsb.entries {
+			b.versions[f.key] = []*mockVersion{{
+				versionID:    "null",
+				path:         f.path,
+				size:         f.size,
+				file:         f,
+				lastModified: f.lastModified,
+			}}
+		}
+		b.dirty = true
+		logger.Info("mock-server loaded bucket", "bucket", e.Name(), "objects", len(fsb.entries))
+	}
+	return nil
+}
+
+// rebuilds the sorted key slices, caller holds the write lock. New slices are
+// allocated so that listings still holding the previous ones are unaffected.
+func (b *mockBucket) sortLocked() {
+	if !b.dirty {
+		return
+	}
+	all := make([]string, 0, len(b.versions))
+	live := make([]string, 0, len(b.versions))
+	for k, v := range b.versions {
+		all = append(all, k)
+		if !v[0].deleteMarker {
+			live = append(live, k)
+		}
+	}
+	sort.Strings(all)
+	sort.Strings(live)
+	b.allKeys, b.liveKeys = all, live
+	b.dirty = false
+}
+
+// returns the sorted keys with any version, or only the live keys
+func (b *mockBucket) sortedKeys(live bool) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sortLocked()
+	if live {
+		return b.liveKeys
+	}
+	return b.allKeys
+}
+
+func (b *mockBucket) liveKeysLocked() []string {
+	var keys []string
+	for k, v := range b.versions {
+		if !v[0].deleteMarker {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// latest version of key, or the version with versionID when given
+func (b *mockBucket) get(key string, versionID string) (*mockVersion, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	versions, ok := b.versions[key]
+	if !ok {
+		return nil, errNoSuchKey
+	}
+	if versionID == "" {
+		if versions[0].deleteMarker {
+			return nil, errNoSuchKey
+		}
+		return versions[0], nil
+	}
+	for _, v := range versions {
+		if v.versionID == versionID {
+			if v.deleteMarker {
+				return nil, errMethodNotAllowed
+			}
+			return v, nil
+		}
+	}
+	return nil, errNoSuchVersion
+}
+
+// path of key in a directory backed bucket, keys with .. segments that would leave the directory are refused
+func (b *mockBucket) keyPath(key string) (string, error) {
+	path := filepath.Join(b.dir, filepath.FromSlash(key))
+	rel, err := filepath.Rel(b.dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errKeyOutsideDir
+	}
+	return path, nil
+}
+
+// stores a new latest version of key
+func (b *mockBucket) put(key string, v *mockVersion) error {
+	if b.dir != "" && !v.deleteMarker {
+		path, err := b.keyPath(key)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, v.data, 0o644); err != nil {
+			return err
+		}
+		v.path = path
+		v.data = nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, existed := b.versions[key]
+	if b.dir != "" {
+		//directory backed buckets are unversioned, the file on disk is the only copy
+		v.versionID = "null"
+		b.versions[key] = []*mockVersion{v}
+		if !existed {
+			b.dirty = true
+		}
+		return nil
+	}
+	b.versions[key] = append([]*mockVersion{v}, b.versions[key]...)
+	if !existed || v.deleteMarker || b.versions[key][1].deleteMarker {
+		b.dirty = true
+	}
+	return nil
+}
+
+// deletes a single version, or adds a delete marker when no version is given
+func (b *mockBucket) remove(key string, versionID string, markerID string) (*mockVersion, error) {
+	path := ""
+	if b.dir != "" {
+		var err error
+		if path, err = b.keyPath(key); err != nil {
+			return nil, err
+		}
+	}
+	if versionID == "" {
+		b.mu.RLock()
+		_, exists := b.versions[key]
+		b.mu.RUnlock()
+		if !exists {
+			//deleting a missing key succeeds without creating anything
+			return nil, nil
+		}
+		if b.dir != "" {
+			return b.remove(key, "null", "")
+		}
+		marker := &mockVersion{versionID: markerID, deleteMarker: true, lastModified: time.Now().UTC()}
+		return marker, b.put(key, marker)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	versions := b.versions[key]
+	for i, v := range versions {
+		if v.versionID != versionID {
+			continue
+		}
+		versions = append(versions[:i:i], versions[i+1:]...)
+		if len(versions) == 0 {
+			delete(b.versions, key)
+		} else {
+			b.versions[key] = versions
+		}
+		b.dirty = true
+		if path != "" {
+			os.Remove(path)
+		}
+		return v, nil
+	}
+	return nil, nil
+}
+
+// versions of a key, newest first
+func (b *mockBucket) keyVersions(key string) []*mockVersion {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.versions[key]
+}
+
+// content of a version
+func (v *mockVersion) open() (io.ReadCloser, error) {
+	if v.path != "" {
+		return os.Open(v.path)
+	}
+	return io.NopCloser(bytes.NewReader(v.data)), nil
+}
+
+func (v *mockVersion) bytes() ([]byte, error) {
+	if v.path != "" {
+		return os.ReadFile(v.path)
+	}
+	return v.data, nil
+}
+
+// ETag of a version, files loaded from --dir are hashed when first asked for
+func (v *mockVersion) eTag() string {
+	if v.file != nil {
+		return v.file.md5ETag()
+	}
+	return v.etag
+}
+
+// builds a version from a request body
+func newMockVersion(versionID string, data []byte, contentType string, meta http.Header) *mockVersion {
+	sum := md5.Sum(data)
+	return &mockVersion{
+		versionID:    versionID,
+		data:         data,
+		size:         int64(len(data)),
+		etag:         `"` + hex.EncodeToString(sum[:]) + `"`,
+		contentType:  contentType,
+		meta:         meta,
+		lastModified: time.Now().UTC(),
+	}
+}
+
+// Joins the parts of a completed upload, the ETag follows the S3 md5-of-md5s-N convention
+func assembleParts(versionID string, parts []*mockVersion) (*mockVersion, error) {
+	var data []byte
+	var sums []byte
+	for _, p := range parts {
+		data = append(data, p.data...)
+		etag := p.eTag()
+		sum, err := hex.DecodeString(etag[1 : len(etag)-1])
+		if err != nil {
+			return nil, errInvalidPart
+		}
+		sums = append(sums, sum...)
+	}
+	v := newMockVersion(versionID, data, "", nil)
+	total := md5.Sum(sums)
+	v.etag = `"` + hex.EncodeToString(total[:]) + "-" + strconv.Itoa(len(parts)) + `"`
+	return v, nil
+}
@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/private/protocol/rest"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const objectTemplateHelp = `--format prints each object with a Go template, followed by a newline (a NUL with --print0).
+\t and \n in the template stand for a tab and a newline. The fields are:
+
+  .Bucket .Key .Size .LastModified .ETag .StorageClass
+  .S3URL   s3://bucket/key
+  .URL     the object URL at the endpoint, path style or virtual-hosted as requests are made
+
+and the functions, on top of the text/template ones:
+
+  human SIZE            1.5 MiB
+  rfc3339 TIME          2006-01-02T15:04:05Z07:00
+  date LAYOUT TIME      TIME in a Go time layout, e.g. date "2006-01-02 15:04"
+  tz ZONE TIME          TIME in an IANA zone, Local or UTC, e.g. tz "Europe/Paris"
+  unix TIME             seconds since 1970
+  escape STRING         C-style escapes as with --escape
+  s3url BUCKET KEY      s3://BUCKET/KEY
+  pick OBJECT NAME...   a map of the named fields, e.g. pick . "Key" "Size"
+  json VALUE            VALUE as JSON
+
+For example:
+
+  --format '{{.Key}}\t{{.Size | human}}\t{{.LastModified | tz "Local" | rfc3339}}'
+  --format '{{.URL}}'
+  --format '{{pick . "Key" "Size" "ETag" | json}}'`
+
+// objectFields is what a --format template sees of an object
+type objectFields struct {
+	Bucket       string
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string
+	StorageClass string
+
+	urlBase string
+}
+
+func (o objectFields) S3URL() string {
+	return objectS3URL(o.Bucket, o.Key)
+}
+
+func (o objectFields) URL() string {
+	if o.urlBase == "" {
+		return ""
+	}
+	return o.urlBase + rest.EscapePath(o.Key, false)
+}
+
+func objectS3URL(bucket string, key string) string {
+	//local buckets are already URLs
+	if _, ok := localBucketRoot(bucket); ok {
+		return strings.TrimSuffix(bucket, "/") + "/" + key
+	}
+	return "s3://" + bucket + "/" + key
+}
+
+// Base of the object URLs of bucket, as the SDK addresses it through svc
+func objectURLBase(svc *s3.S3, bucket string) string {
+	endpoint := strings.TrimSuffix(svc.Endpoint, "/")
+	if aws.BoolValue(svc.Config.S3ForcePathStyle) || !virtualHostCompatible(svc.Endpoint, bucket) {
+		return endpoint + "/" + bucket + "/"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return endpoint + "/" + bucket + "/"
+	}
+	u.Host = bucket + "." + u.Host
+	return u.String() + "/"
+}
+
+// Formats bytes with binary units, e.g. 512 B or 1.5 MiB
+func humanSize(size int64) string {
+	const units = "KMGTPE"
+	if size < 1024 && size > -1024 {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+	value := float64(size)
+	i := -1
+	for (value >= 1024 || value <= -1024) && i < len(units)-1 {
+		value /= 1024
+		i++
+	}
+	return strconv.FormatFloat(value, 'f', 1, 64) + " " + units[i:i+1] + "iB"
+}
+
+// time zones by name, loading one reads the zone database
+var timeZones sync.Map
+
+func inTimeZone(name string, t time.Time) (time.Time, error) {
+	if loc, ok := timeZones.Load(name); ok {
+		return t.In(loc.(*time.Location)), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return t, err
+	}
+	timeZones.Store(name, loc)
+	return t.In(loc), nil
+}
+
+func (o objectFields) fieldMap() map[string]any {
+	return map[string]any{
+		"Bucket":       o.Bucket,
+		"Key":          o.Key,
+		"Size":         o.Size,
+		"LastModified": o.LastModified,
+		"ETag":         o.ETag,
+		"StorageClass": o.StorageClass,
+		"S3URL":        o.S3URL(),
+		"URL":          o.URL(),
+	}
+}
+
+var objectTemplateFuncs = template.FuncMap{
+	"human":   humanSize,
+	"rfc3339": func(t time.Time) string { return t.Format(time.RFC3339) },
+	"date":    func(layout string, t time.Time) string { return t.Format(layout) },
+	"tz":      inTimeZone,
+	"unix":    func(t time.Time) int64 { return t.Unix() },
+	"escape":  func(s string) string { return string(appendEscapedKey(nil, s)) },
+	"s3url":   objectS3URL,
+	"pick": func(o objectFields, names ...string) (map[string]any, error) {
+		fields := o.fieldMap()
+		picked := make(map[string]any, len(names))
+		for _, name := range names {
+			value, ok := fields[name]
+			if !ok {
+				return nil, fmt.Errorf("pick: no field %q", name)
+			}
+			picked[name] = value
+		}
+		return picked, nil
+	},
+	"json": func(v any) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+}
+
+// \t and \n in a --format, so templates can be given in single quotes
+var formatEscapes = strings.NewReplacer(`\t`, "\t", `\n`, "\n")
+
+// appendWriter appends what is written to buf
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// Returns an encoder printing objects of bucket with the --format template, each followed by
+// terminator. The template is tried on a sample object so mistakes show before listing starts.
+func newTemplateEncoder(format string, bucket string, urlBase string, terminator byte) (objectEncoder, error) {
+	tmpl, err := template.New("format").Funcs(objectTemplateFuncs).Parse(formatEscapes.Replace(format))
+	if err != nil {
+		return nil, err
+	}
+	sample := objectFields{Bucket: bucket, Key: "sample", LastModified: time.Now(), urlBase: urlBase}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, err
+	}
+
+	return func(buf []byte, object *s3.Object) []byte {
+		w := &appendWriter{buf: buf}
+		fields := objectFields{
+			Bucket:       bucket,
+			Key:          aws.StringValue(object.Key),
+			Size:         aws.Int64Value(object.Size),
+			LastModified: aws.TimeValue(object.LastModified),
+			ETag:         aws.StringValue(object.ETag),
+			StorageClass: aws.StringValue(object.StorageClass),
+			urlBase:      urlBase,
+		}
+		if err := tmpl.Execute(w, fields); err != nil {
+			log.Fatalln("error: --format:", err)
+		}
+		return append(w.buf, terminator)
+	}, nil
+}
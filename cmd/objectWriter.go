@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"runtime"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// size of the output buffer, and of the channel of pages between listers and the writer
+const (
+	outputBufferSize = 256 << 10
+	objectBatchQueue = 64
+)
+
+// objectEncoder appends the output line of an object to buf
+type objectEncoder func(buf []byte, object *s3.Object) []byte
+
+// time.Time.String() layout, what fmt's %v printed before
+const objectTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// "Object: <last modified> \t <size> \t <key>" lines
+func encodeObjectText(buf []byte, object *s3.Object) []byte {
+	buf = append(buf, "Object: "...)
+	buf = object.LastModified.AppendFormat(buf, objectTimeLayout)
+	buf = append(buf, " \t "...)
+	buf = strconv.AppendInt(buf, *object.Size, 10)
+	buf = append(buf, " \t "...)
+	buf = append(buf, *object.Key...)
+	return append(buf, '\n')
+}
+
+// the text lines with --escape
+func encodeObjectEscaped(buf []byte, object *s3.Object) []byte {
+	buf = append(buf, "Object: "...)
+	buf = object.LastModified.AppendFormat(buf, objectTimeLayout)
+	buf = append(buf, " \t "...)
+	buf = strconv.AppendInt(buf, *object.Size, 10)
+	buf = append(buf, " \t "...)
+	buf = appendEscapedKey(buf, *object.Key)
+	return append(buf, '\n')
+}
+
+// the key and a NUL, for xargs -0
+func encodeObjectKey0(buf []byte, object *s3.Object) []byte {
+	buf = append(buf, *object.Key...)
+	return append(buf, 0)
+}
+
+// Appends key with C-style escapes for backslash, control and non printable characters
+// and \xHH for bytes that are not UTF-8, so every key is one line and can be decoded back.
+func appendEscapedKey(buf []byte, key string) []byte {
+	for i := 0; i < len(key); {
+		r, size := utf8.DecodeRuneInString(key[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			buf = appendHexEscape(buf, key[i])
+		case r == '\\':
+			buf = append(buf, `\\`...)
+		case r == '\n':
+			buf = append(buf, `\n`...)
+		case r == '\r':
+			buf = append(buf, `\r`...)
+		case r == '\t':
+			buf = append(buf, `\t`...)
+		case r < utf8.RuneSelf && !strconv.IsPrint(r):
+			buf = appendHexEscape(buf, byte(r))
+		case !strconv.IsPrint(r):
+			//line and paragraph separators, format characters and the like
+			if r > 0xffff {
+				buf = append(buf, `\U`...)
+				buf = appendHex(buf, uint32(r), 8)
+			} else {
+				buf = append(buf, `\u`...)
+				buf = appendHex(buf, uint32(r), 4)
+			}
+		default:
+			buf = append(buf, key[i:i+size]...)
+		}
+		i += size
+	}
+	return buf
+}
+
+func appendHexEscape(buf []byte, b byte) []byte {
+	buf = append(buf, `\x`...)
+	return appendHex(buf, uint32(b), 2)
+}
+
+func appendHex(buf []byte, v uint32, digits int) []byte {
+	const hex = "0123456789abcdef"
+	for shift := (digits - 1) * 4; shift >= 0; shift -= 4 {
+		buf = append(buf, hex[v>>uint(shift)&0xf])
+	}
+	return buf
+}
+
+// Picks the encoder of list-objects-v2 output for --print0, --escape and --format,
+// urlBase is the start of the object URLs for the template .URL field
+func objectEncoderFor(fPrint0 bool, fEscape bool, fFormat string, fBucketName string, urlBase string) (objectEncoder, error) {
+	switch {
+	case fPrint0 && fEscape:
+		return nil, fmt.Errorf("use either --print0 or --escape, not both")
+	case fFormat != "" && fEscape:
+		return nil, fmt.Errorf("--escape does not apply to --format, use {{.Key | escape}} in the template")
+	case fFormat != "":
+		terminator := byte('\n')
+		if fPrint0 {
+			terminator = 0
+		}
+		encode, err := newTemplateEncoder(fFormat, fBucketName, urlBase, terminator)
+		if err != nil {
+			return nil, fmt.Errorf("--format: %w", err)
+		}
+		return encode, nil
+	case fPrint0:
+		return encodeObjectKey0, nil
+	case fEscape:
+		return encodeObjectEscaped, nil
+	}
+	return encodeObjectText, nil
+}
+
+// buffers of encoded pages, reused between batches
+var encodeBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 0, 64<<10)
+	return &buf
+}}
+
+// Encodes the pages of objects from ch with one goroutine per CPU and writes them through
+// a single buffered writer, so lines are never interleaved. Returns the objects written.
+func writeObjects(w io.Writer, ch <-chan []*s3.Object, encode objectEncoder) (int64, error) {
+	encoded := make(chan *[]byte, objectBatchQueue)
+	var objects int64
+	var mu sync.Mutex
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var count int64
+			for batch := range ch {
+				buf := encodeBuffers.Get().(*[]byte)
+				for _, object := range batch {
+					*buf = encode(*buf, object)
+				}
+				count += int64(len(batch))
+				encoded <- buf
+			}
+			mu.Lock()
+			objects += count
+			mu.Unlock()
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(encoded)
+	}()
+
+	bw := bufio.NewWriterSize(w, outputBufferSize)
+	var err error
+	for buf := range encoded {
+		//keep draining on errors so the listers are never blocked
+		if err == nil {
+			_, err = bw.Write(*buf)
+		}
+		*buf = (*buf)[:0]
+		encodeBuffers.Put(buf)
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	return objects, err
+}
@@ -0,0 +1,301 @@
+package cmd
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// keyRange is the keys with prefix from from on and, when set, before before
+type keyRange struct {
+	prefix string
+	from   string
+	before string
+}
+
+// partition is the part of a large prefix one worker lists: the keys with prefix
+// from from on and, once it has been split, before before.
+type partition struct {
+	prefix string
+	from   string
+	root   *partition //the discovered prefix it was split from
+	span   keyRange   //on the root, the range it was queued with
+
+	mu      sync.Mutex
+	before  string
+	first   string
+	last    string
+	pages   int
+	started time.Time
+
+	//on the root, for all of its pieces
+	objects int64
+	pieces  int32
+}
+
+func newRootPartition(r keyRange) *partition {
+	p := &partition{prefix: r.prefix, from: r.from, before: r.before, span: r, pieces: 1}
+	p.root = p
+	return p
+}
+
+// partitionScheduler lists partitions with a pool of workers. A worker that finds the
+// queue empty while others are still listing splits the remaining keys of the longest
+// running of them, and the pieces go to the idle workers.
+type partitionScheduler struct {
+	svc        s3Lister
+	bucketName string
+	chs3Object chan<- []*s3.Object
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*partition
+	running map[*partition]bool
+	idle    int
+}
+
+func newPartitionScheduler(svc s3Lister, fBucketName string, ranges []keyRange, chs3Object chan<- []*s3.Object) *partitionScheduler {
+	s := &partitionScheduler{svc: svc, bucketName: fBucketName, chs3Object: chs3Object, running: make(map[*partition]bool)}
+	s.cond = sync.NewCond(&s.mu)
+	for _, r := range ranges {
+		s.queue = append(s.queue, newRootPartition(r))
+	}
+	return s
+}
+
+// Lists every partition with workers goroutines and returns when all are done
+func (s *partitionScheduler) run(workers int) {
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := s.next(); p != nil; p = s.next() {
+				s.finish(p, s.list(p))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Returns the next partition to list, splitting a straggler when the queue is empty, nil when all are done
+func (s *partitionScheduler) next() *partition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if len(s.queue) > 0 {
+			p := s.queue[0]
+			s.queue = s.queue[1:]
+			p.started = time.Now()
+			s.running[p] = true
+			return p
+		}
+		if len(s.running) == 0 {
+			return nil
+		}
+		if s.steal() {
+			continue
+		}
+		s.idle++
+		s.cond.Wait()
+		s.idle--
+	}
+}
+
+// Splits the longest running partition that can be split, called with s.mu held
+func (s *partitionScheduler) steal() bool {
+	var running []*partition
+	for p := range s.running {
+		running = append(running, p)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].started.Before(running[j].started) })
+
+	for _, p := range running {
+		if pieces := s.split(p, s.idle+1); len(pieces) > 0 {
+			s.queue = append(s.queue, pieces...)
+			return true
+		}
+	}
+	return false
+}
+
+// Hands the keys of p after the last one listed to at most n new partitions. Only
+// partitions that have listed a couple of pages are split, short ones are left alone.
+func (s *partitionScheduler) split(p *partition, n int) []*partition {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pages < 2 {
+		return nil
+	}
+	points := splitPoints(p.prefix, p.first, p.last, p.before, n)
+	if len(points) == 0 {
+		return nil
+	}
+
+	var pieces []*partition
+	for i, point := range points {
+		before := p.before
+		if i+1 < len(points) {
+			before = points[i+1]
+		}
+		pieces = append(pieces, &partition{prefix: p.prefix, from: point, before: before, root: p.root})
+	}
+	logger.Debug("splitting straggler prefix", "bucket", s.bucketName, "prefix", p.prefix, "last_key", p.last, "pages", p.pages, "pieces", len(pieces))
+	stats.add("partition_splits", 1)
+	stats.add("partition_pieces", int64(len(pieces)))
+
+	p.before = points[0]
+	atomic.AddInt32(&p.root.pieces, int32(len(pieces)))
+	return pieces
+}
+
+// Returns up to n keys after last and before before (none when empty) that start new
+// partitions. The keys from first to last share a start, the characters after it are where
+// the keys listed so far vary, so the points are that start and each shorter one down to
+// prefix followed by one more character of the same kind as in last, the nearest to last
+// first: the pieces close to last are the size of what was listed, the last piece holds
+// everything further away.
+func splitPoints(prefix string, first string, last string, before string, n int) []string {
+	common := len(prefix)
+	for common < len(first) && common < len(last) && first[common] == last[common] {
+		common++
+	}
+	//never cut a multi-byte character
+	for common > len(prefix) && common < len(last) && !utf8.RuneStart(last[common]) {
+		common--
+	}
+
+	var candidates []string
+	for d := len(prefix); d <= common; d++ {
+		if d < len(last) && !utf8.RuneStart(last[d]) {
+			continue
+		}
+		for _, c := range characters {
+			k := last[:d] + c
+			if d < len(last) && charClass(c[0]) != charClass(last[d]) {
+				continue
+			}
+			if k > last && (before == "" || k < before) {
+				candidates = append(candidates, k)
+			}
+		}
+	}
+	sort.Strings(candidates)
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// digits, lower case, upper case or other, keys mostly keep one kind at a position
+func charClass(b byte) int {
+	switch {
+	case b >= '0' && b <= '9':
+		return 0
+	case b >= 'a' && b <= 'z':
+		return 1
+	case b >= 'A' && b <= 'Z':
+		return 2
+	}
+	return 3
+}
+
+// above the last key of every prefix in valid UTF-8 but the ones past it
+const prefixRangeEnd = "\U0010FFFF"
+
+// StartAfter for a partition beginning at key. Only keys past U+10FFFF lie between the
+// two, list drops them.
+func keyBefore(key string) string {
+	last := key[len(key)-1]
+	if last == 0 {
+		return key[:len(key)-1]
+	}
+	return key[:len(key)-1] + string([]byte{last - 1}) + prefixRangeEnd
+}
+
+// Pages through p until its keys run out or reach the start of a piece split from it
+func (s *partitionScheduler) list(p *partition) int64 {
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(s.bucketName),
+		MaxKeys: aws.Int64(maxKeys),
+	}
+	if p.prefix != "" {
+		params.Prefix = aws.String(p.prefix)
+	}
+	if p.from != "" {
+		params.StartAfter = aws.String(keyBefore(p.from))
+	}
+
+	var count int64
+	for {
+		resp, err := s3ListObjectsV2PageWithBackoff(s.svc, s.bucketName, params)
+		if err != nil {
+			log.Fatalln("Error listing objects for prefix:", p.prefix, err)
+			//os.Exit(1) called implicitly by log.Fatal
+		}
+		//keys StartAfter let through below from belong to the partition before
+		batch := resp.Contents
+		if p.from != "" {
+			batch = batch[sort.Search(len(batch), func(i int) bool { return *batch[i].Key >= p.from }):]
+		}
+		//cut under the lock so a split never hands out a key already listed
+		p.mu.Lock()
+		cut := false
+		if p.before != "" {
+			n := sort.Search(len(batch), func(i int) bool { return *batch[i].Key >= p.before })
+			cut = n < len(batch)
+			batch = batch[:n]
+		}
+		if len(batch) > 0 {
+			if p.first == "" {
+				p.first = *batch[0].Key
+			}
+			p.last = *batch[len(batch)-1].Key
+		}
+		p.mu.Unlock()
+
+		if len(batch) > 0 {
+			s.chs3Object <- batch
+			count += int64(len(batch))
+		}
+		if cut || !aws.BoolValue(resp.IsTruncated) {
+			return count
+		}
+
+		p.mu.Lock()
+		p.pages++
+		p.mu.Unlock()
+		//idle workers may be waiting for a partition to split
+		s.mu.Lock()
+		if s.idle > 0 {
+			s.cond.Broadcast()
+		}
+		s.mu.Unlock()
+
+		params.ContinuationToken = resp.NextContinuationToken
+	}
+}
+
+func (s *partitionScheduler) finish(p *partition, count int64) {
+	s.mu.Lock()
+	delete(s.running, p)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	root := p.root
+	atomic.AddInt64(&root.objects, count)
+	if atomic.AddInt32(&root.pieces, -1) > 0 {
+		return
+	}
+	objects := atomic.LoadInt64(&root.objects)
+	logTrace("large prefix listed", "bucket", s.bucketName, "prefix", root.prefix, "objects", objects)
+	stats.add("large_prefixes_listed", 1)
+	planRecorder.addRange(root.span, objects)
+}
@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// sortedLister answers ListObjectsV2 from keys in S3 byte order, continuation
+// tokens are the last key of the page
+type sortedLister struct {
+	keys  []string
+	delay time.Duration
+}
+
+func newSortedLister(keys []string, delay time.Duration) *sortedLister {
+	sorted := append([]string(nil), keys...)
+	sort.Strings(sorted)
+	return &sortedLister{keys: sorted, delay: delay}
+}
+
+func (l *sortedLister) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	time.Sleep(l.delay)
+	prefix := aws.StringValue(input.Prefix)
+	after := aws.StringValue(input.StartAfter)
+	if input.ContinuationToken != nil {
+		after = *input.ContinuationToken
+	}
+	max := int(aws.Int64Value(input.MaxKeys))
+
+	resp := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	i := sort.Search(len(l.keys), func(i int) bool { return l.keys[i] > after })
+	for ; i < len(l.keys); i++ {
+		if !strings.HasPrefix(l.keys[i], prefix) {
+			if l.keys[i] > prefix {
+				break
+			}
+			continue
+		}
+		if len(resp.Contents) == max {
+			last := *resp.Contents[max-1].Key
+			resp.IsTruncated = aws.Bool(true)
+			resp.NextContinuationToken = aws.String(last)
+			break
+		}
+		resp.Contents = append(resp.Contents, &s3.Object{Key: aws.String(l.keys[i])})
+	}
+	resp.KeyCount = aws.Int64(int64(len(resp.Contents)))
+	return resp, nil
+}
+
+// Collects the keys sent to a channel until it is closed
+func collectKeys(ch <-chan []*s3.Object) <-chan []string {
+	done := make(chan []string)
+	go func() {
+		var keys []string
+		for batch := range ch {
+			for _, o := range batch {
+				keys = append(keys, *o.Key)
+			}
+		}
+		done <- keys
+	}()
+	return done
+}
+
+// Fails unless got holds every key of want exactly once and nothing else
+func checkListedOnce(t *testing.T, want []string, got []string) {
+	t.Helper()
+	seen := make(map[string]int)
+	for _, k := range got {
+		seen[k]++
+	}
+	for _, k := range want {
+		if seen[k] != 1 {
+			t.Errorf("key %q listed %d times", k, seen[k])
+		}
+		delete(seen, k)
+	}
+	for k, n := range seen {
+		t.Errorf("key %q listed %d times, not in the bucket", k, n)
+	}
+}
+
+func TestKeyBefore(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"b", "a" + prefixRangeEnd},
+		{"ab", "aa" + prefixRangeEnd},
+		{"a1", "a0" + prefixRangeEnd},
+		{"a\x00", "a"},
+		{"\x00", ""},
+		{"a\x01", "a\x00" + prefixRangeEnd},
+	}
+	for _, tt := range tests {
+		if got := keyBefore(tt.key); got != tt.want {
+			t.Errorf("keyBefore(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+		if got := keyBefore(tt.key); got >= tt.key {
+			t.Errorf("keyBefore(%q) = %q is not below the key", tt.key, got)
+		}
+	}
+}
+
+func TestSplitPoints(t *testing.T) {
+	tests := []struct {
+		name                        string
+		prefix, first, last, before string
+		n                           int
+		want                        []string
+	}{
+		{"digits", "a", "a0000", "a0042", "", 3, []string{"a005", "a006", "a007"}},
+		{"up to before", "a", "a0000", "a0042", "a007", 5, []string{"a005", "a006"}},
+		{"letters", "", "aa", "ax", "", 2, []string{"ay", "az"}},
+		{"nothing left", "a", "a0000", "a0042", "a0043", 4, nil},
+		{"multi-byte last", "p/", "p/é0", "p/é5", "", 2, []string{"p/é6", "p/é7"}},
+	}
+	for _, tt := range tests {
+		got := splitPoints(tt.prefix, tt.first, tt.last, tt.before, tt.n)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: splitPoints = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Split points must stay after last, before before, sorted, and never cut a character
+func TestSplitPointsBounds(t *testing.T) {
+	lasts := []string{"k/0999", "k/日本/0042", "k/éa", "k/zz", "k/é", "k/日"}
+	for _, last := range lasts {
+		for _, before := range []string{"", "k/日本/1", "k/éb"} {
+			points := splitPoints("k/", "k/", last, before, 8)
+			if !sort.StringsAreSorted(points) {
+				t.Errorf("last %q: points %q are not sorted", last, points)
+			}
+			for _, p := range points {
+				if p <= last || (before != "" && p >= before) {
+					t.Errorf("last %q before %q: point %q out of range", last, before, p)
+				}
+				if !utf8.ValidString(p) {
+					t.Errorf("last %q: point %q cuts a character", last, p)
+				}
+			}
+		}
+	}
+}
+
+func TestPartitionListBounds(t *testing.T) {
+	keys := []string{"a", "a" + prefixRangeEnd + "z", "b", "b0", "c", "x!" + prefixRangeEnd + "z", "x\"a", "x#", "x$"}
+	svc := newSortedLister(keys, 0)
+
+	sweeps := sweepRanges("x")
+	tests := []struct {
+		name string
+		r    keyRange
+		want []string
+	}{
+		{"from drops keys past U+10FFFF before it", keyRange{from: "b"}, []string{"b", "b0", "c", "x!" + prefixRangeEnd + "z", "x\"a", "x#", "x$"}},
+		{"before", keyRange{from: "a", before: "b"}, []string{"a", "a" + prefixRangeEnd + "z"}},
+		{"after a key", keyRange{prefix: "b", from: "b\x00"}, []string{"b0"}},
+		{"sweep", sweeps[1], []string{"x\"a", "x#"}},
+	}
+	for _, tt := range tests {
+		ch := make(chan []*s3.Object, 16)
+		done := collectKeys(ch)
+		s := newPartitionScheduler(svc, "bucket", []keyRange{tt.r}, ch)
+		s.list(newRootPartition(tt.r))
+		close(ch)
+		if got := <-done; strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: listed %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSweepRangesCoverUnprobedBytes(t *testing.T) {
+	var probed [256]bool
+	for _, c := range characters {
+		probed[c[0]] = true
+	}
+	ranges := sweepRanges("p")
+	for b := 0; b < 256; b++ {
+		key := "p" + string([]byte{byte(b)}) + "k"
+		in := 0
+		for _, r := range ranges {
+			if key >= r.from && (r.before == "" || key < r.before) {
+				in++
+			}
+		}
+		if probed[b] && in != 0 {
+			t.Errorf("byte %#x is probed and swept", b)
+		}
+		if !probed[b] && in != 1 {
+			t.Errorf("byte %#x is in %d sweeps", b, in)
+		}
+	}
+}
+
+// Every key is listed once however the stragglers are split
+func TestPartitionSchedulerListsEveryKeyOnce(t *testing.T) {
+	defer func(n int64) { maxKeys = n }(maxKeys)
+	maxKeys = 20
+
+	var keys []string
+	for i := 0; i < 3000; i++ {
+		keys = append(keys, fmt.Sprintf("a%05d", i))
+	}
+	//keys between a split point and the StartAfter of the piece it starts
+	for i := 0; i < 300; i++ {
+		keys = append(keys, fmt.Sprintf("a%04d%sz", i, prefixRangeEnd))
+	}
+	keys = append(keys, "b", "b1", "c"+prefixRangeEnd)
+	svc := newSortedLister(keys, time.Millisecond)
+
+	ranges := []keyRange{{prefix: "a"}, {prefix: "b", from: "b\x00"}, {prefix: "c"}}
+	ch := make(chan []*s3.Object, 64)
+	done := collectKeys(ch)
+	s := newPartitionScheduler(svc, "bucket", ranges, ch)
+
+	s.run(8)
+	close(ch)
+
+	var want []string
+	for _, k := range keys {
+		if k != "b" {
+			want = append(want, k)
+		}
+	}
+	checkListedOnce(t, want, <-done)
+}
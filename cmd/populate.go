@@ -0,0 +1,134 @@
+/*
+Copyright © 2023 Jean-Baptiste Thomas <jboothomas@gmail.com>
+This file is part of CLI application pS3.
+*/
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// populateCmd represents the populate command
+var populateCmd = &cobra.Command{
+	Use:   "populate",
+	Short: "Creates large numbers of synthetic objects in a bucket.",
+	Long: `Creates --count zero byte or small objects in parallel, with keys built from --pattern, to build
+realistic test buckets for prefix discovery and --prefix-count tuning.
+
+--pattern takes one of ` + strings.Join(keyShapeNames(), ", ") + ` or a key template, for example
+'logs/{date:2006/01/02}/{uuid}.json' or 'tenant{seq:4}/{hex:8}'. Keys are derived from the object index and
+--seed, so an interrupted run can be resumed with --start.
+
+` + keyTemplateHelp,
+	Run: func(cmd *cobra.Command, args []string) {
+		fBucketName, _ := cmd.Flags().GetString("bucket")
+		fCount, _ := cmd.Flags().GetInt("count")
+		fStart, _ := cmd.Flags().GetInt("start")
+		fPattern, _ := cmd.Flags().GetString("pattern")
+		fPrefix, _ := cmd.Flags().GetString("prefix")
+		fSize, _ := cmd.Flags().GetString("size")
+		fConcurrency, _ := cmd.Flags().GetInt("concurrency")
+		fSeed, _ := cmd.Flags().GetInt64("seed")
+		fDryRun, _ := cmd.Flags().GetBool("dry-run")
+		populate(fBucketName, fCount, fStart, fPattern, fPrefix, fSize, fConcurrency, fSeed, fDryRun, fEndpointUrl, fProfile, fRegion, fNoVerifySSL)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(populateCmd)
+
+	populateCmd.Flags().String("bucket", "", "Bucket to populate (required)")
+	populateCmd.MarkFlagRequired("bucket")
+	populateCmd.Flags().Int("count", 10000, "Number of objects to create.")
+	populateCmd.Flags().Int("start", 0, "Index of the first object, to resume an interrupted run.")
+	populateCmd.Flags().String("pattern", "uuid", "Key shape ("+strings.Join(keyShapeNames(), ", ")+") or key template.")
+	populateCmd.Flags().String("prefix", "", "Prefix added in front of every key.")
+	populateCmd.Flags().String("size", "0", "Object size, or min-max range, e.g. 0-4KiB.")
+	populateCmd.Flags().Int("concurrency", maxSemaphore, "Number of PUT requests in flight.")
+	populateCmd.Flags().Int64("seed", 1, "Seed for keys and sizes.")
+	populateCmd.Flags().Bool("dry-run", false, "Print the keys instead of creating objects.")
+}
+
+func populate(fBucketName string, fCount int, fStart int, fPattern string, fPrefix string, fSize string, fConcurrency int, fSeed int64, fDryRun bool, fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool) {
+
+	logTrace("populate", "bucket", fBucketName, "count", fCount, "start", fStart, "pattern", fPattern, "prefix", fPrefix, "size", fSize, "concurrency", fConcurrency, "seed", fSeed)
+
+	keyGen, err := newKeyGenerator(fPattern, fSeed)
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+	minSize, maxSize, err := parseSizeRange(fSize)
+	if err != nil {
+		log.Fatalln("error:", err)
+	}
+	if fConcurrency < 1 {
+		log.Fatalln("error: --concurrency must be at least 1")
+	}
+
+	end := fStart + fCount
+	if fDryRun {
+		for i := fStart; i < end; i++ {
+			fmt.Println(fPrefix + keyGen(i))
+		}
+		return
+	}
+
+	payload := make([]byte, maxSize)
+	rand.New(rand.NewSource(fSeed)).Read(payload)
+	size := func(i int) int64 {
+		if maxSize == minSize {
+			return minSize
+		}
+		return minSize + int64(mix64(uint64(fSeed)^uint64(i)^0x5eed)%uint64(maxSize-minSize+1))
+	}
+
+	svc := newS3Service(fBucketName, fEndpointUrl, fProfile, fRegion, fNoVerifySSL)
+
+	var created, failed, bytes int64
+	next := make(chan int, fConcurrency)
+	var wg sync.WaitGroup
+
+	for w := 0; w < fConcurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				key := fPrefix + keyGen(i)
+				n := size(i)
+				if err := s3PutObjectWithBackoff(svc, fBucketName, key, payload[:n]); err != nil {
+					atomic.AddInt64(&failed, 1)
+					logger.Error("put failed", "key", key, "index", i, "error", err)
+					continue
+				}
+				atomic.AddInt64(&created, 1)
+				atomic.AddInt64(&bytes, n)
+			}
+		}()
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for i := fStart; i < end; i++ {
+		select {
+		case <-ticker.C:
+			done := atomic.LoadInt64(&created)
+			logger.Info("populate progress", "bucket", fBucketName, "created", done, "count", fCount, "per_second", int64(float64(done)/time.Since(start).Seconds()), "next_index", i)
+		default:
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	fmt.Printf("created %d objects (%d bytes) in %s, %.0f objects/s, %d failed\n", created, bytes, elapsed.Round(time.Millisecond), float64(created)/elapsed.Seconds(), failed)
+}
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// prefixes listed by this run with their object counts, for --save-plan and the
+// stale check of --plan, nil when neither is set
+var planRecorder *prefixPlan
+
+// planEntry is a prefix listed as a whole, or the part of it from from on and before
+// before, or with exact set a key that is also the start of longer prefixes and is
+// listed on its own
+type planEntry struct {
+	Prefix  string `json:"prefix"`
+	From    string `json:"from,omitempty"`
+	Before  string `json:"before,omitempty"`
+	Objects int64  `json:"objects"`
+	Exact   bool   `json:"exact,omitempty"`
+}
+
+// the lowest key the entry lists
+func (e planEntry) start() string {
+	if e.From > e.Prefix {
+		return e.From
+	}
+	return e.Prefix
+}
+
+// the lowest key above the entry, false when it runs to the end of the bucket
+func (e planEntry) end() (string, bool) {
+	switch {
+	case e.Exact:
+		return e.Prefix + "\x00", true
+	case e.Before != "":
+		return e.Before, true
+	}
+	return prefixEnd(e.Prefix)
+}
+
+// the lowest key above every key with prefix, false when there is none
+func prefixEnd(prefix string) (string, bool) {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1}), true
+		}
+	}
+	return "", false
+}
+
+// prefixPlan is the partition of a bucket found by findPrefixes. Listing every
+// entry lists the bucket as it was when the plan was saved.
+type prefixPlan struct {
+	Bucket      string      `json:"bucket"`
+	Created     time.Time   `json:"created"`
+	PrefixCount int         `json:"prefix_count"`
+	Objects     int64       `json:"objects"`
+	Prefixes    []planEntry `json:"prefixes"`
+
+	mu sync.Mutex
+}
+
+func newPrefixPlan(bucket string, prefixCount int) *prefixPlan {
+	return &prefixPlan{Bucket: bucket, PrefixCount: prefixCount}
+}
+
+// records a listed prefix or key
+func (p *prefixPlan) add(prefix string, objects int64, exact bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.Prefixes = append(p.Prefixes, planEntry{Prefix: prefix, Objects: objects, Exact: exact})
+	p.Objects += objects
+	p.mu.Unlock()
+}
+
+// records a listed key range
+func (p *prefixPlan) addRange(r keyRange, objects int64) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.Prefixes = append(p.Prefixes, planEntry{Prefix: r.prefix, From: r.from, Before: r.before, Objects: objects})
+	p.Objects += objects
+	p.mu.Unlock()
+}
+
+// Sorts the entries by their first key, keys that a listed prefix already covers are dropped
+func (p *prefixPlan) normalize() {
+	sort.Slice(p.Prefixes, func(i, j int) bool {
+		if a, b := p.Prefixes[i].start(), p.Prefixes[j].start(); a != b {
+			return a < b
+		}
+		return !p.Prefixes[i].Exact
+	})
+	entries := p.Prefixes[:0]
+	for _, e := range p.Prefixes {
+		if n := len(entries); n > 0 && entries[n-1].Prefix == e.Prefix && entries[n-1].From == e.From && entries[n-1].Before == e.Before {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	p.Prefixes = entries
+}
+
+// Writes the plan without the entries that turned out empty
+func (p *prefixPlan) save(file string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.normalize()
+	entries := p.Prefixes[:0]
+	for _, e := range p.Prefixes {
+		if e.Objects > 0 {
+			entries = append(entries, e)
+		}
+	}
+	p.Prefixes = entries
+	p.Created = time.Now().UTC()
+
+	out, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(out, '\n'), 0o644)
+}
+
+func loadPlan(file string, bucket string) (*prefixPlan, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := &prefixPlan{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if p.Bucket != bucket {
+		return nil, fmt.Errorf("%s is a plan for bucket %s, not %s", file, p.Bucket, bucket)
+	}
+	p.normalize()
+	return p, nil
+}
+
+// planGap is the key range from from on and before hi between the entries of a plan,
+// no hi means the end of the bucket
+type planGap struct {
+	from, hi string
+	noHi     bool
+}
+
+func (g planGap) contains(key string) bool {
+	return key >= g.from && (g.noHi || key < g.hi)
+}
+
+// the ranges a plan does not list, in key order
+func (p *prefixPlan) gaps() []planGap {
+	var gaps []planGap
+	from := ""
+	for _, e := range p.Prefixes {
+		//entries that follow each other leave nothing between them
+		if hi := e.start(); from < hi {
+			gaps = append(gaps, planGap{from: from, hi: hi})
+		}
+		end, ok := e.end()
+		if !ok {
+			return gaps
+		}
+		if end > from {
+			from = end
+		}
+	}
+	return append(gaps, planGap{from: from, noHi: true})
+}
+
+// Lists the bucket from a saved plan: keys are listed on their own, the ranges between
+// entries are checked with one LIST each and the ones that hold objects since the plan was
+// saved are listed whole. Returns the ranges for listObjectsInParallel, the gaps with
+// objects first and then the planned prefixes largest first, and the number of gaps that
+// held objects.
+func listPlan(svc s3Lister, fBucketName string, plan *prefixPlan, chs3Object chan<- []*s3.Object, fDebug bool) ([]keyRange, int) {
+
+	var mu sync.Mutex
+	var staleGaps []planGap
+	semaphore := make(chan struct{}, maxSemaphore)
+	var checks sync.WaitGroup
+
+	for _, gap := range plan.gaps() {
+		checks.Add(1)
+		go func(gap planGap) {
+			defer checks.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			after := ""
+			if gap.from != "" {
+				after = keyBefore(gap.from)
+			}
+			for {
+				resp, err := s3ListObjectsWithBackOff(svc, fBucketName, "", after, "", 1)
+				if err != nil {
+					log.Fatalln("Error checking plan:", err)
+				}
+				if len(resp.Contents) == 0 {
+					return
+				}
+				key := *resp.Contents[0].Key
+				if key < gap.from {
+					//past U+10FFFF, in the entry before
+					after = key
+					continue
+				}
+				if gap.contains(key) {
+					logger.Info("objects outside the plan", "bucket", fBucketName, "from", gap.from, "key", key)
+					mu.Lock()
+					staleGaps = append(staleGaps, gap)
+					mu.Unlock()
+				}
+				return
+			}
+		}(gap)
+	}
+
+	for _, e := range plan.Prefixes {
+		if !e.Exact {
+			continue
+		}
+		checks.Add(1)
+		go func(key string) {
+			defer checks.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+			listPlanKey(svc, fBucketName, key, chs3Object)
+		}(e.Prefix)
+	}
+	checks.Wait()
+
+	//new keys first, nothing is known of how many there are, the scheduler splits
+	//the gaps that turn out large
+	var prefixes []keyRange
+	for _, gap := range staleGaps {
+		prefixes = append(prefixes, keyRange{from: gap.from, before: gap.hi})
+	}
+
+	var planned []planEntry
+	for _, e := range plan.Prefixes {
+		if !e.Exact {
+			planned = append(planned, e)
+		}
+	}
+	sort.SliceStable(planned, func(i, j int) bool { return planned[i].Objects > planned[j].Objects })
+	stats.add("large_prefixes_discovered", int64(len(planned)))
+	for _, e := range planned {
+		prefixes = append(prefixes, keyRange{prefix: e.Prefix, from: e.From, before: e.Before})
+	}
+	return prefixes, len(staleGaps)
+}
+
+// Lists a key that is also the start of longer prefixes
+func listPlanKey(svc s3Lister, fBucketName string, key string, chs3Object chan<- []*s3.Object) {
+	resp, err := s3ListObjectsWithBackOff(svc, fBucketName, key, "", "", 1)
+	if err != nil {
+		log.Fatalln("Error listing objects:", err)
+	}
+	if len(resp.Contents) > 0 && *resp.Contents[0].Key == key {
+		chs3Object <- resp.Contents[:1]
+		planRecorder.add(key, 1, true)
+	}
+}
+
+// Warns when the listing no longer matches the plan it started from
+func checkPlanStale(fBucketName string, plan *prefixPlan, staleGaps int, fSavePlan string) {
+	listed := planRecorder.Objects
+	drift := listed - plan.Objects
+	if drift < 0 {
+		drift = -drift
+	}
+	if staleGaps == 0 && drift*4 <= plan.Objects {
+		logger.Info("plan is current", "bucket", fBucketName, "planned_objects", plan.Objects, "listed_objects", listed)
+		return
+	}
+	args := []any{"bucket", fBucketName, "created", plan.Created, "gaps_with_objects", staleGaps, "planned_objects", plan.Objects, "listed_objects", listed}
+	if fSavePlan == "" {
+		args = append(args, "hint", "refresh it with --save-plan")
+	}
+	logger.Warn("plan is stale", args...)
+}
@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanGaps(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []planEntry
+		want    []planGap
+	}{
+		{
+			"empty plan",
+			nil,
+			[]planGap{{from: "", noHi: true}},
+		},
+		{
+			"prefixes",
+			[]planEntry{{Prefix: "a"}, {Prefix: "c"}},
+			[]planGap{{from: "", hi: "a"}, {from: "b", hi: "c"}, {from: "d", noHi: true}},
+		},
+		{
+			"adjacent prefixes",
+			[]planEntry{{Prefix: "a"}, {Prefix: "b"}},
+			[]planGap{{from: "", hi: "a"}, {from: "c", noHi: true}},
+		},
+		{
+			"exact key then its prefix listed after it",
+			[]planEntry{{Prefix: "k", Exact: true}, {Prefix: "k", From: "k\x00"}},
+			[]planGap{{from: "", hi: "k"}, {from: "l", noHi: true}},
+		},
+		{
+			"exact key with a gap after it",
+			[]planEntry{{Prefix: "k", Exact: true}, {Prefix: "k0"}},
+			[]planGap{{from: "", hi: "k"}, {from: "k\x00", hi: "k0"}, {from: "k1", noHi: true}},
+		},
+		{
+			"ranges",
+			[]planEntry{{Prefix: "p", From: "p\x00", Before: "p "}, {Prefix: "p", From: "p\"", Before: "p$"}},
+			[]planGap{{from: "", hi: "p\x00"}, {from: "p ", hi: "p\""}, {from: "p$", noHi: true}},
+		},
+		{
+			"range to the end of the bucket",
+			[]planEntry{{Prefix: "a"}, {From: "{"}},
+			[]planGap{{from: "", hi: "a"}, {from: "b", hi: "{"}},
+		},
+		{
+			"prefix ending in the last byte",
+			[]planEntry{{Prefix: "a\xff"}},
+			[]planGap{{from: "", hi: "a\xff"}, {from: "b", noHi: true}},
+		},
+	}
+	for _, tt := range tests {
+		p := &prefixPlan{Prefixes: tt.entries}
+		p.normalize()
+		got := p.gaps()
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: gaps = %#v, want %#v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: gap %d = %#v, want %#v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+// A key is in a gap exactly when no entry lists it
+func TestPlanGapsCoverUnlistedKeys(t *testing.T) {
+	entries := []planEntry{
+		{Prefix: "a"},
+		{Prefix: "k", Exact: true},
+		{Prefix: "k", From: "k\x00"},
+		{Prefix: "p", From: "p\x00", Before: "p "},
+		{Prefix: "p!"},
+		{Prefix: "p", From: "p\"", Before: "p$"},
+	}
+	listed := func(key string) bool {
+		for _, e := range entries {
+			switch {
+			case e.Exact:
+				if key == e.Prefix {
+					return true
+				}
+			case strings.HasPrefix(key, e.Prefix) && key >= e.From && (e.Before == "" || key < e.Before):
+				return true
+			}
+		}
+		return false
+	}
+	p := &prefixPlan{Prefixes: append([]planEntry(nil), entries...)}
+	p.normalize()
+	gaps := p.gaps()
+
+	keys := []string{"", "0", "a", "a" + prefixRangeEnd + "z", "b", "k", "k\x00", "k0", "l", "p", "p\x01", "p ", "p!", "p!x", "p\"", "p#z", "p$", "p%", "q", "~", "é"}
+	for _, key := range keys {
+		in := 0
+		for _, g := range gaps {
+			if g.contains(key) {
+				in++
+			}
+		}
+		if want := !listed(key); (in == 1) != want || in > 1 {
+			t.Errorf("key %q is in %d gaps, listed by the plan: %v", key, in, listed(key))
+		}
+	}
+}
+
+func TestPlanNormalize(t *testing.T) {
+	p := &prefixPlan{Prefixes: []planEntry{
+		{Prefix: "b", Objects: 5},
+		{Prefix: "a", Exact: true, Objects: 1},
+		{Prefix: "a", Objects: 10},
+		{Prefix: "b", Objects: 5},
+		{Prefix: "b", From: "b\x00", Objects: 4},
+	}}
+	p.normalize()
+	var got []string
+	for _, e := range p.Prefixes {
+		got = append(got, e.Prefix+"|"+e.From)
+	}
+	//the key a is listed with the prefix, b once, the range after b stays
+	want := []string{"a|", "b|", "b|b\x00"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("normalize = %q, want %q", got, want)
+	}
+	if p.Prefixes[0].Exact {
+		t.Errorf("normalize kept the exact key a over its prefix")
+	}
+}
+
+func TestLoadPlan(t *testing.T) {
+	dir := t.TempDir()
+	saved := newPrefixPlan("bucket-a", 500)
+	saved.add("x", 3, false)
+	saved.addRange(keyRange{prefix: "y", from: "y\x00"}, 7)
+	file := filepath.Join(dir, "plan.json")
+	if err := saved.save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := loadPlan(file, "bucket-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Objects != 10 || len(p.Prefixes) != 2 || p.Prefixes[1].From != "y\x00" {
+		t.Errorf("loaded %+v", p)
+	}
+
+	if _, err := loadPlan(file, "bucket-b"); err == nil || !strings.Contains(err.Error(), "bucket-a") {
+		t.Errorf("loadPlan of another bucket: %v", err)
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	os.WriteFile(bad, []byte("{"), 0o644)
+	if _, err := loadPlan(bad, "bucket-a"); err == nil {
+		t.Errorf("loadPlan accepted a broken file")
+	}
+}
@@ -0,0 +1,264 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// deepest discovery --prefix-count auto considers, and how many characters of the
+// sampled keys it reads to estimate how many keys a prefix holds
+const (
+	maxTunedDepth    = 8
+	samplePositions  = 6
+	maxPrefixObjects = 1e12
+)
+
+// Parses --prefix-count, a number or auto
+func parsePrefixCount(value string) (count int, auto bool, err error) {
+	if value == "auto" {
+		return 0, true, nil
+	}
+	count, err = strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return 0, false, fmt.Errorf("--prefix-count must be a number or auto, not %q", value)
+	}
+	return count, false, nil
+}
+
+// probeCache hands the first level probes of the sample to findPrefixes, each
+// one once, so sampling costs no LIST of its own
+type probeCache struct {
+	s3Lister
+
+	mu    sync.Mutex
+	pages map[string]*s3.ListObjectsV2Output
+}
+
+func (c *probeCache) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	if input.ContinuationToken == nil && input.StartAfter == nil && aws.Int64Value(input.MaxKeys) == maxKeys {
+		c.mu.Lock()
+		resp, ok := c.pages[aws.StringValue(input.Prefix)]
+		delete(c.pages, aws.StringValue(input.Prefix))
+		c.mu.Unlock()
+		if ok {
+			return resp, nil
+		}
+	}
+	return c.s3Lister.ListObjectsV2(input)
+}
+
+// bucketShape is what the first level of probes tells of a bucket
+type bucketShape struct {
+	small        int     //prefixes listed by their probe
+	smallObjects int     //keys those probes listed
+	large        int     //prefixes of a full page
+	largeObjects float64 //estimated keys under the large prefixes
+	chain        int     //levels under a large prefix before its keys branch out
+	fanout       int     //prefixes at the level where they do
+}
+
+// Probes every first level prefix in parallel and picks the discovery depth and the
+// prefix count for findPrefixes that list the bucket in the least time with workers,
+// then in the fewest LIST calls. Returns svc with the probes cached for findPrefixes.
+func tunePrefixCount(svc s3Lister, fBucketName string, workers int) (s3Lister, int, int) {
+	cache := &probeCache{s3Lister: svc, pages: make(map[string]*s3.ListObjectsV2Output)}
+	semaphore := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for _, c := range characters {
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			resp, err := s3ListObjectsWithBackOff(svc, fBucketName, prefix, "", "", maxKeys)
+			if err != nil {
+				log.Fatalln("Error listing objects:", err)
+			}
+			cache.mu.Lock()
+			cache.pages[prefix] = resp
+			cache.mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	shape := bucketShape{fanout: 1}
+	var chains, fanouts int
+	for prefix, resp := range cache.pages {
+		switch n := len(resp.Contents); {
+		case n > 999:
+			keys := make([]string, n)
+			for i, object := range resp.Contents {
+				keys[i] = *object.Key
+			}
+			objects, chain, fanout := estimatePrefix(prefix, keys)
+			shape.large++
+			shape.largeObjects += objects
+			chains += chain
+			fanouts += fanout
+		case n > 0:
+			shape.small++
+			shape.smallObjects += n
+		}
+	}
+	if shape.large > 0 {
+		shape.chain = (chains + shape.large/2) / shape.large
+		shape.fanout = (fanouts + shape.large/2) / shape.large
+	}
+
+	depth, target, wall, calls := shape.plan(workers)
+	logger.Info("prefix count tuned", "bucket", fBucketName, "small_prefixes", shape.small, "large_prefixes", shape.large,
+		"estimated_objects", int64(shape.largeObjects)+int64(shape.smallObjects), "chain", shape.chain, "fanout", shape.fanout,
+		"depth", depth, "prefix_count", target, "estimated_rounds", int64(wall), "estimated_lists", int64(calls))
+	return cache, target, depth
+}
+
+// Estimates the keys under prefix from the first ones, sorted as listed. Where the first
+// and last keys part, they count through characters of one kind, digits say: the part of
+// that range they cover gives the number of keys, assuming the rest is as dense. Also
+// returns the levels below prefix the keys share, and how many characters the first
+// differing position can take.
+func estimatePrefix(prefix string, keys []string) (float64, int, int) {
+	first, last := keys[0], keys[len(keys)-1]
+	vary := len(prefix)
+	for vary < len(first) && vary < len(last) && first[vary] == last[vary] {
+		vary++
+	}
+	if vary >= len(last) {
+		return float64(len(keys)), 0, 1
+	}
+	//leading zeros and the like belong to the number that varies
+	start := vary
+	class := charClass(last[vary])
+	for class != 3 && start > len(prefix) && charClass(last[start-1]) == class {
+		start--
+	}
+
+	var ranks [samplePositions][256]int
+	var bases [samplePositions]int
+	for i := range bases {
+		bases[i] = positionAlphabet(keys, start+i, &ranks[i])
+	}
+	value := func(key string) float64 {
+		v, scale := 0.0, 1.0
+		for i := range bases {
+			scale /= float64(bases[i])
+			if start+i < len(key) {
+				v += float64(ranks[i][key[start+i]]) * scale
+			}
+		}
+		return v
+	}
+	unit := 1.0
+	for _, base := range bases {
+		unit /= float64(base)
+	}
+
+	span := value(last) - value(first) + unit
+	objects := math.Min(float64(len(keys))/span, maxPrefixObjects)
+	return math.Max(objects, float64(len(keys))), start - len(prefix), bases[0]
+}
+
+// Ranks the characters keys can hold at pos: every digit, lower or upper case letter
+// when one of the kind is seen, and the other characters seen. Returns how many there are.
+func positionAlphabet(keys []string, pos int, ranks *[256]int) int {
+	var seen [256]bool
+	var classes [4]bool
+	for _, key := range keys {
+		if pos < len(key) {
+			seen[key[pos]] = true
+			classes[charClass(key[pos])] = true
+		}
+	}
+	var alphabet []int
+	for b := 0; b < 256; b++ {
+		class := charClass(byte(b))
+		if seen[b] || (class != 3 && classes[class]) {
+			alphabet = append(alphabet, b)
+		}
+	}
+	if len(alphabet) == 0 {
+		return 1
+	}
+	sort.Ints(alphabet)
+	for i, b := range alphabet {
+		ranks[b] = i
+	}
+	return len(alphabet)
+}
+
+// Weighs discovering down to each depth against listing what is left with workers, in
+// rounds of one LIST latency: each level of discovery probes every character one after
+// the other, listing goes a page per worker and round once stragglers have been split.
+// Returns the depth, the prefix count findPrefixes reaches there, and the estimates.
+func (b bucketShape) plan(workers int) (depth int, target int, wall float64, calls float64) {
+	type option struct {
+		depth       int
+		target      int
+		wall, calls float64
+	}
+	var options []option
+
+	nodes := float64(b.large)
+	processed := float64(b.small + b.large)
+	expanded := 0.0
+	perNode := 0.0
+	sweeps := float64(len(sweepRanges("")))
+	if b.large > 0 {
+		perNode = b.largeObjects / nodes
+	}
+	for d := 1; d <= maxTunedDepth; d++ {
+		pages := math.Ceil(nodes * perNode / float64(maxKeys))
+		//and sweeps the characters it does not probe, in parallel with the listing
+		probes := float64(len(characters)) * (1 + expanded)
+		o := option{depth: d, target: int(math.Min(processed, math.MaxInt32)), calls: probes + sweeps*(1+expanded) + pages + nodes}
+		o.wall = 1 + float64(len(characters))*float64(d-1)
+		if pages > 0 {
+			//partitions of two pages or more are split between idle workers
+			parallel := math.Min(float64(workers), math.Max(nodes, pages/2))
+			if nodes < parallel {
+				o.wall += 2 * math.Ceil(math.Log2(parallel/nodes))
+			}
+			o.wall += math.Ceil(pages / parallel)
+		}
+		options = append(options, o)
+
+		if pages == 0 {
+			break
+		}
+		//one level deeper
+		fanout := float64(b.fanout)
+		if d <= b.chain {
+			fanout = 1
+		}
+		expanded += nodes
+		processed += nodes * fanout
+		perNode /= fanout
+		nodes *= fanout
+		if perNode < float64(maxKeys) {
+			//the next level is listed by its probes
+			nodes, perNode = 0, 0
+		}
+	}
+
+	fastest := options[0].wall
+	for _, o := range options[1:] {
+		fastest = math.Min(fastest, o.wall)
+	}
+	//close enough in time, fewer calls wins
+	best := option{calls: math.Inf(1)}
+	for _, o := range options {
+		if o.wall <= fastest*1.1 && o.calls < best.calls {
+			best = o
+		}
+	}
+	return best.depth, best.target, best.wall, best.calls
+}
@@ -0,0 +1,471 @@
+/*
+Copyright © 2023 Jean-Baptiste Thomas <jboothomas@gmail.com>
+This file is part of CLI application pS3.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/cobra"
+)
+
+// probeCmd represents the probe command
+var probeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Reports which S3 features an endpoint supports.",
+	Long: `Checks an S3-compatible endpoint for ListObjectsV2 and V1, ListObjectVersions, GetBucketLocation and
+HeadBucket region behaviour, HTTP/2 negotiation, path and virtual-hosted addressing, and unless --read-only is
+given, Content-MD5 and checksum headers, the multipart upload minimum part size and ranged UploadPartCopy
+using temporary objects under pS3-probe/ that are deleted afterwards.
+
+Prints a compatibility matrix and recommended pS3 settings.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		fBucketName, _ := cmd.Flags().GetString("bucket")
+		fReadOnly, _ := cmd.Flags().GetBool("read-only")
+		probe(fBucketName, fReadOnly, fEndpointUrl, fProfile, fRegion, fNoVerifySSL, fOutput)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(probeCmd)
+
+	probeCmd.Flags().String("bucket", "", "Bucket to run the checks against (required)")
+	probeCmd.MarkFlagRequired("bucket")
+	probeCmd.Flags().Bool("read-only", false, "Skip the checks that write temporary objects.")
+}
+
+const (
+	probeYes     = "yes"
+	probeNo      = "no"
+	probePartial = "partial"
+	probeSkipped = "skipped"
+)
+
+// probeResult is one row of the compatibility matrix
+type probeResult struct {
+	Feature string `json:"feature"`
+	Result  string `json:"result"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// probeReport is the probe command output
+type probeReport struct {
+	Endpoint        string        `json:"endpoint"`
+	Bucket          string        `json:"bucket"`
+	Region          string        `json:"region"`
+	Results         []probeResult `json:"results"`
+	Recommendations []string      `json:"recommendations"`
+}
+
+func (r *probeReport) add(feature string, result string, detail string) probeResult {
+	res := probeResult{Feature: feature, Result: result, Detail: detail}
+	r.Results = append(r.Results, res)
+	logger.Info("probe", "feature", feature, "result", result, "detail", detail)
+	return res
+}
+
+func (r *probeReport) recommend(format string, a ...interface{}) {
+	r.Recommendations = append(r.Recommendations, fmt.Sprintf(format, a...))
+}
+
+// short form of an SDK error for the matrix
+func probeErrorDetail(err error) string {
+	if awsErr, ok := err.(awserr.RequestFailure); ok {
+		return fmt.Sprintf("%s (HTTP %d)", awsErr.Code(), awsErr.StatusCode())
+	}
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() + ": " + awsErr.Message()
+	}
+	return err.Error()
+}
+
+func probe(fBucketName string, fReadOnly bool, fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool, fOutput string) {
+
+	logTrace("probe", "bucket", fBucketName, "endpoint", fEndpointUrl, "read_only", fReadOnly)
+
+	sess := newS3Session(fEndpointUrl, fProfile, fRegion, fNoVerifySSL)
+	report := &probeReport{Endpoint: fEndpointUrl, Bucket: fBucketName}
+	if report.Endpoint == "" {
+		report.Endpoint = "AWS S3"
+	}
+
+	//region discovery decides which region the other checks sign for
+	region := probeRegion(sess, fBucketName, fRegion, report)
+	report.Region = region
+	svc := newS3Client(sess, &aws.Config{Region: aws.String(region)})
+
+	probeListV2(svc, fBucketName, report)
+	probeListV1(svc, fBucketName, report)
+	probeListVersions(svc, fBucketName, report)
+	probeHTTP2(sess, fEndpointUrl, report)
+	probeAddressing(sess, fBucketName, region, report)
+
+	if fReadOnly {
+		report.add("Write checks", probeSkipped, "--read-only")
+	} else {
+		probeWrites(svc, fBucketName, report)
+	}
+
+	printProbeReport(report, fOutput)
+}
+
+func probeRegion(sess *session.Session, fBucketName string, fRegion string, report *probeReport) string {
+	signRegion := fRegion
+	if signRegion == "" {
+		signRegion = aws.StringValue(sess.Config.Region)
+	}
+	if signRegion == "" {
+		signRegion = "us-east-1"
+	}
+	svc := newS3Client(sess, &aws.Config{Region: aws.String(signRegion)})
+
+	region := ""
+	location, locationErr := svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(fBucketName)})
+	switch {
+	case locationErr != nil:
+		report.add("GetBucketLocation", probeNo, probeErrorDetail(locationErr))
+	case location.LocationConstraint == nil || *location.LocationConstraint == "":
+		report.add("GetBucketLocation", probeYes, "empty constraint (us-east-1 or no regions)")
+	default:
+		region = *location.LocationConstraint
+		report.add("GetBucketLocation", probeYes, region)
+	}
+
+	req, _ := svc.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(fBucketName)})
+	err := req.Send()
+	headRegion := ""
+	if req.HTTPResponse != nil {
+		headRegion = req.HTTPResponse.Header.Get("x-amz-bucket-region")
+	}
+	switch {
+	case headRegion != "":
+		report.add("HeadBucket x-amz-bucket-region", probeYes, headRegion)
+	case err != nil:
+		report.add("HeadBucket x-amz-bucket-region", probeNo, probeErrorDetail(err))
+	default:
+		report.add("HeadBucket x-amz-bucket-region", probeNo, "header not returned")
+	}
+
+	if region == "" {
+		region = headRegion
+	}
+	if locationErr != nil && headRegion == "" && fRegion == "" {
+		report.recommend("the bucket region cannot be discovered, pass --region")
+	}
+	if region == "" {
+		region = signRegion
+	}
+	return region
+}
+
+func probeListV2(svc *s3.S3, fBucketName string, report *probeReport) bool {
+	const feature = "ListObjectsV2"
+
+	first, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(fBucketName), MaxKeys: aws.Int64(1)})
+	if err != nil {
+		report.add(feature, probeNo, probeErrorDetail(err))
+		report.recommend("ListObjectsV2 failed, pS3 list-objects-v2 cannot be used against this endpoint")
+		return false
+	}
+	if first.KeyCount == nil {
+		report.add(feature, probePartial, "KeyCount missing, list-type=2 may be ignored")
+		report.recommend("the endpoint appears to answer ListObjectsV2 with V1 results, check listings for completeness")
+		return true
+	}
+	if aws.BoolValue(first.IsTruncated) {
+		if first.NextContinuationToken == nil {
+			report.add(feature, probePartial, "truncated page without NextContinuationToken")
+			report.recommend("ListObjectsV2 pagination is broken, listings will stop after the first page")
+			return true
+		}
+		second, err := svc.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(fBucketName), MaxKeys: aws.Int64(1), ContinuationToken: first.NextContinuationToken})
+		if err != nil {
+			report.add(feature, probePartial, "continuation failed: "+probeErrorDetail(err))
+			return true
+		}
+		if len(first.Contents) == 1 && len(second.Contents) == 1 && *second.Contents[0].Key <= *first.Contents[0].Key {
+			report.add(feature, probePartial, "keys not returned in ascending order")
+			report.recommend("keys are not listed in UTF-8 binary order, prefix discovery may miss objects")
+			return true
+		}
+	}
+	report.add(feature, probeYes, "")
+	return true
+}
+
+func probeListV1(svc *s3.S3, fBucketName string, report *probeReport) {
+	resp, err := s3listObjects(svc, fBucketName, "", "", "", 1)
+	switch {
+	case err != nil:
+		report.add("ListObjects (V1)", probeNo, probeErrorDetail(err))
+	case aws.BoolValue(resp.IsTruncated) && resp.NextMarker == nil:
+		report.add("ListObjects (V1)", probeYes, "NextMarker only with a delimiter")
+	default:
+		report.add("ListObjects (V1)", probeYes, "")
+	}
+}
+
+func probeListVersions(svc *s3.S3, fBucketName string, report *probeReport) {
+	_, err := s3listObjectVersions(svc, fBucketName, "", "", "", 1)
+	if err != nil {
+		report.add("ListObjectVersions", probeNo, probeErrorDetail(err))
+		return
+	}
+	versioning, err := svc.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String(fBucketName)})
+	if err != nil || versioning.Status == nil {
+		report.add("ListObjectVersions", probeYes, "bucket versioning not enabled")
+		return
+	}
+	report.add("ListObjectVersions", probeYes, "bucket versioning "+*versioning.Status)
+}
+
+// The client asks for h2 through ALPN, this shows whether the server agrees
+func probeHTTP2(sess *session.Session, fEndpointUrl string, report *probeReport) {
+	const feature = "HTTP/2"
+
+	endpoint := fEndpointUrl
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	//the client does not offer h2, a recommendation would only restate the flags
+	if fHTTP1Only || len(fEndpointAddresses) > 0 {
+		report.add(feature, probeSkipped, "HTTP/1.1 forced")
+		return
+	}
+	if strings.HasPrefix(endpoint, "http://") {
+		report.add(feature, probeSkipped, "plain HTTP endpoint, HTTP/1.1 is used")
+		return
+	}
+
+	resp, err := sess.Config.HTTPClient.Get(endpoint)
+	if err != nil {
+		report.add(feature, probeNo, err.Error())
+		if strings.Contains(err.Error(), "certificate") {
+			report.recommend("TLS verification failed, check the endpoint certificate or use --no-verify-ssl for testing only")
+		}
+		return
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor == 2 {
+		report.add(feature, probeYes, resp.Proto)
+		return
+	}
+	report.add(feature, probeNo, "negotiated "+resp.Proto)
+	report.recommend("HTTP/2 is not negotiated, each parallel request needs its own connection, keep concurrency within the endpoint connection limits")
+}
+
+func probeAddressing(sess *session.Session, fBucketName string, region string, report *probeReport) {
+	path := newS3Client(sess, &aws.Config{Region: aws.String(region), S3ForcePathStyle: aws.Bool(true)})
+	_, pathErr := path.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(fBucketName), MaxKeys: aws.Int64(1)})
+	if pathErr != nil {
+		report.add("Path-style addressing", probeNo, probeErrorDetail(pathErr))
+	} else {
+		report.add("Path-style addressing", probeYes, "")
+	}
+
+	virtual := newS3Client(sess, &aws.Config{Region: aws.String(region), S3ForcePathStyle: aws.Bool(false)})
+	if !virtualHostCompatible(virtual.Endpoint, fBucketName) {
+		report.add("Virtual-hosted addressing", probeSkipped, "bucket name cannot be a host name on this endpoint")
+		return
+	}
+	_, err := virtual.ListObjectsV2(&s3.ListObjectsV2Input{Bucket: aws.String(fBucketName), MaxKeys: aws.Int64(1)})
+	if err != nil {
+		report.add("Virtual-hosted addressing", probeNo, probeErrorDetail(err))
+		if pathErr == nil && !aws.BoolValue(sess.Config.S3ForcePathStyle) {
+			report.recommend("the endpoint only accepts path-style requests, use --addressing-style path")
+		}
+		return
+	}
+	report.add("Virtual-hosted addressing", probeYes, "")
+	if pathErr != nil && aws.BoolValue(sess.Config.S3ForcePathStyle) {
+		report.recommend("the endpoint only accepts virtual-hosted requests, use --addressing-style virtual")
+	}
+}
+
+// Checks that need to write, every object created is removed at the end
+func probeWrites(svc *s3.S3, fBucketName string, report *probeReport) {
+	prefix := "pS3-probe/" + time.Now().UTC().Format("20060102T150405") + "/"
+	var created []string
+	defer func() {
+		for _, key := range created {
+			if _, err := svc.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String(fBucketName), Key: aws.String(key)}); err != nil {
+				logger.Warn("could not delete probe object", "key", key, "error", err)
+			}
+		}
+	}()
+
+	source := prefix + "source"
+	_, err := svc.PutObject(&s3.PutObjectInput{Bucket: aws.String(fBucketName), Key: aws.String(source), Body: bytes.NewReader([]byte("pS3 probe"))})
+	if err != nil {
+		report.add("PutObject", probeNo, probeErrorDetail(err))
+		report.add("Write checks", probeSkipped, "PutObject failed")
+		return
+	}
+	created = append(created, source)
+	report.add("PutObject", probeYes, "")
+
+	//a wrong Content-MD5 must be rejected
+	badKey := prefix + "bad-md5"
+	req, _ := svc.PutObjectRequest(&s3.PutObjectInput{Bucket: aws.String(fBucketName), Key: aws.String(badKey), Body: bytes.NewReader([]byte("pS3 probe"))})
+	req.HTTPRequest.Header.Set("Content-MD5", "1B2M2Y8AsgTpgAmY7PhCfg==")
+	if err := req.Send(); err != nil {
+		report.add("Content-MD5 validation", probeYes, probeErrorDetail(err))
+	} else {
+		created = append(created, badKey)
+		report.add("Content-MD5 validation", probeNo, "wrong Content-MD5 accepted")
+		report.recommend("the endpoint does not validate Content-MD5, data integrity relies on TLS")
+	}
+
+	probeChecksum(svc, fBucketName, prefix+"checksum", &created, report)
+	probeMultipart(svc, fBucketName, prefix, source, &created, report)
+}
+
+func probeChecksum(svc *s3.S3, fBucketName string, key string, created *[]string, report *probeReport) {
+	const feature = "Checksum headers (CRC32)"
+
+	_, err := svc.PutObject(&s3.PutObjectInput{
+		Bucket:            aws.String(fBucketName),
+		Key:               aws.String(key),
+		Body:              bytes.NewReader([]byte("pS3 probe")),
+		ChecksumAlgorithm: aws.String(s3.ChecksumAlgorithmCrc32),
+	})
+	if err != nil {
+		report.add(feature, probeNo, probeErrorDetail(err))
+		return
+	}
+	*created = append(*created, key)
+
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(fBucketName), Key: aws.String(key), ChecksumMode: aws.String(s3.ChecksumModeEnabled)})
+	if err != nil {
+		report.add(feature, probePartial, "accepted, HeadObject failed: "+probeErrorDetail(err))
+		return
+	}
+	if head.ChecksumCRC32 == nil {
+		report.add(feature, probePartial, "accepted but not returned")
+		return
+	}
+	report.add(feature, probeYes, "")
+}
+
+func probeMultipart(svc *s3.S3, fBucketName string, prefix string, source string, created *[]string, report *probeReport) {
+	//uploads to the same key complete over each other, probes started in the same second share prefix
+	key := fmt.Sprintf("%smultipart-%08x", prefix, rand.Uint32())
+
+	upload := func(parts func(uploadID *string) ([]*s3.CompletedPart, error)) error {
+		mpu, err := svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String(fBucketName), Key: aws.String(key)})
+		if err != nil {
+			return err
+		}
+		completed, err := parts(mpu.UploadId)
+		if err == nil {
+			_, err = svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+				Bucket:          aws.String(fBucketName),
+				Key:             aws.String(key),
+				UploadId:        mpu.UploadId,
+				MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+			})
+		}
+		if err != nil {
+			svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String(fBucketName), Key: aws.String(key), UploadId: mpu.UploadId})
+			return err
+		}
+		*created = append(*created, key)
+		return nil
+	}
+
+	putPart := func(uploadID *string, n int64, data []byte) (*s3.CompletedPart, error) {
+		resp, err := svc.UploadPart(&s3.UploadPartInput{
+			Bucket:     aws.String(fBucketName),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int64(n),
+			Body:       bytes.NewReader(data),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &s3.CompletedPart{ETag: resp.ETag, PartNumber: aws.Int64(n)}, nil
+	}
+
+	//two tiny parts, S3 rejects every part but the last below 5MiB
+	err := upload(func(uploadID *string) ([]*s3.CompletedPart, error) {
+		p1, err := putPart(uploadID, 1, []byte("a"))
+		if err != nil {
+			return nil, err
+		}
+		p2, err := putPart(uploadID, 2, []byte("b"))
+		if err != nil {
+			return nil, err
+		}
+		return []*s3.CompletedPart{p1, p2}, nil
+	})
+	switch {
+	case err == nil:
+		report.add("Multipart upload", probeYes, "5MiB minimum part size not enforced")
+	case strings.Contains(probeErrorDetail(err), "EntityTooSmall"):
+		report.add("Multipart upload", probeYes, "5MiB minimum part size enforced")
+	default:
+		report.add("Multipart upload", probeNo, probeErrorDetail(err))
+		return
+	}
+
+	//a ranged part copy of the source object as the only part
+	err = upload(func(uploadID *string) ([]*s3.CompletedPart, error) {
+		resp, err := svc.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:          aws.String(fBucketName),
+			Key:             aws.String(key),
+			UploadId:        uploadID,
+			PartNumber:      aws.Int64(1),
+			CopySource:      aws.String(fBucketName + "/" + source),
+			CopySourceRange: aws.String("bytes=0-2"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return []*s3.CompletedPart{{ETag: resp.CopyPartResult.ETag, PartNumber: aws.Int64(1)}}, nil
+	})
+	if err != nil {
+		report.add("UploadPartCopy (ranged)", probeNo, probeErrorDetail(err))
+		return
+	}
+	head, err := svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(fBucketName), Key: aws.String(key)})
+	if err != nil || aws.Int64Value(head.ContentLength) != 3 {
+		report.add("UploadPartCopy (ranged)", probePartial, "copy source range not honoured")
+		return
+	}
+	report.add("UploadPartCopy (ranged)", probeYes, "")
+}
+
+func printProbeReport(report *probeReport, fOutput string) {
+	if fOutput == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+		return
+	}
+
+	fmt.Printf("endpoint: %s  bucket: %s  region: %s\n\n", report.Endpoint, report.Bucket, report.Region)
+	fmt.Printf("%-32s %-8s %s\n", "FEATURE", "RESULT", "DETAIL")
+	for _, r := range report.Results {
+		fmt.Printf("%-32s %-8s %s\n", r.Feature, r.Result, r.Detail)
+	}
+
+	fmt.Println("\nRecommended settings:")
+	if len(report.Recommendations) == 0 {
+		fmt.Println("  defaults")
+	}
+	for _, r := range report.Recommendations {
+		fmt.Println("  -", r)
+	}
+}
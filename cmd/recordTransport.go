@@ -0,0 +1,441 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// request bodies above this size are not captured, only their length, response
+// bodies above it go to a file of their own as they are read
+const maxRecordedRequestBody = 64 * 1024
+
+// headers and query parameters that carry credentials and are never written to disk
+var redactedHeaders = []string{"Authorization", "X-Amz-Security-Token", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Amz-Server-Side-Encryption-Customer-Key"}
+var redactedQuery = []string{"X-Amz-Credential", "X-Amz-Signature", "X-Amz-Security-Token", "Signature", "AWSAccessKeyId"}
+
+// STS operations whose bodies carry credentials, credentialExchange also matches the
+// instance and container credential endpoints
+var credentialOperations = []string{"AssumeRole", "AssumeRoleWithWebIdentity", "AssumeRoleWithSAML", "GetSessionToken", "GetFederationToken"}
+
+// credentials in XML, JSON and form bodies
+var redactedBodyFields = []*regexp.Regexp{
+	regexp.MustCompile(`(<(?:SecretAccessKey|SessionToken|WebIdentityToken|SAMLAssertion)>)[^<]*`),
+	regexp.MustCompile(`("(?:SecretAccessKey|SessionToken|Token)"\s*:\s*")[^"]*`),
+	regexp.MustCompile(`((?:^|&)(?:WebIdentityToken|SAMLAssertion)=)[^&]*`),
+}
+
+// httpExchange is one recorded request/response pair, stored as a JSON file per request
+type httpExchange struct {
+	Sequence  int64         `json:"sequence"`
+	Operation string        `json:"operation"`
+	Time      time.Time     `json:"time"`
+	LatencyMs float64       `json:"latency_ms"`
+	Request   recordedHTTP  `json:"request"`
+	Response  *recordedHTTP `json:"response,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+type recordedHTTP struct {
+	Method     string      `json:"method,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	Status     int         `json:"status,omitempty"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+	BodyBase64 string      `json:"body_base64,omitempty"`
+	BodyFile   string      `json:"body_file,omitempty"` //next to the exchange, for large response bodies
+	BodyLength int64       `json:"body_length"`
+	BodyLost   bool        `json:"body_lost,omitempty"` //the body could not be written while recording
+}
+
+func (r *recordedHTTP) setBody(b []byte) {
+	r.BodyLength = int64(len(b))
+	if utf8.Valid(b) {
+		r.Body = string(b)
+	} else {
+		r.BodyBase64 = base64.StdEncoding.EncodeToString(b)
+	}
+}
+
+// Opens the recorded body, dir holds the body files
+func (r *recordedHTTP) body(dir string) (io.ReadCloser, error) {
+	switch {
+	case r.BodyFile != "":
+		return os.Open(filepath.Join(dir, r.BodyFile))
+	case r.BodyBase64 != "":
+		b, err := base64.StdEncoding.DecodeString(r.BodyBase64)
+		return io.NopCloser(bytes.NewReader(b)), err
+	}
+	return io.NopCloser(strings.NewReader(r.Body)), nil
+}
+
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range redactedHeaders {
+		if out.Get(name) != "" {
+			out.Set(name, "REDACTED")
+		}
+	}
+	return out
+}
+
+func redactURL(u *url.URL) string {
+	c := *u
+	c.User = nil
+	q := c.Query()
+	for _, name := range redactedQuery {
+		if q.Has(name) {
+			q.Set(name, "REDACTED")
+		}
+	}
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// Reports whether an exchange carries credentials in its bodies
+func credentialExchange(req *http.Request, operation string, body []byte) bool {
+	action := req.URL.Query().Get("Action")
+	if form, err := url.ParseQuery(string(body)); err == nil && form.Get("Action") != "" {
+		action = form.Get("Action")
+	}
+	for _, name := range credentialOperations {
+		if operation == name || action == name {
+			return true
+		}
+	}
+	//instance metadata and container credential endpoints
+	return strings.Contains(req.URL.Path, "/security-credentials") || req.URL.Hostname() == "169.254.170.2"
+}
+
+func redactBody(b []byte) []byte {
+	for _, re := range redactedBodyFields {
+		b = re.ReplaceAll(b, []byte("${1}REDACTED"))
+	}
+	return b
+}
+
+// recordTransport writes every request/response pair to a directory
+type recordTransport struct {
+	next     http.RoundTripper
+	dir      string
+	sequence int64
+}
+
+func newRecordTransport(next http.RoundTripper, dir string) (*recordTransport, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	logger.Info("recording HTTP exchanges", "dir", dir)
+	return &recordTransport{next: next, dir: dir}, nil
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ex := &httpExchange{
+		Sequence:  atomic.AddInt64(&t.sequence, 1),
+		Operation: s3OperationName(req),
+		Time:      time.Now().UTC(),
+		Request: recordedHTTP{
+			Method:     req.Method,
+			URL:        redactURL(req.URL),
+			Header:     redactHeader(req.Header),
+			BodyLength: req.ContentLength,
+		},
+	}
+
+	var reqBody []byte
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength >= 0 && req.ContentLength <= maxRecordedRequestBody {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(b))
+		reqBody = b
+	}
+	credentials := credentialExchange(req, ex.Operation, reqBody)
+	if credentials {
+		reqBody = redactBody(reqBody)
+	}
+	if reqBody != nil {
+		ex.Request.setBody(reqBody)
+	}
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		ex.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+		ex.Error = err.Error()
+		t.write(ex)
+		return resp, err
+	}
+	ex.Response = &recordedHTTP{Status: resp.StatusCode, Header: redactHeader(resp.Header)}
+
+	if !credentials {
+		//recorded as the caller reads it, written when it is closed
+		resp.Body = &recordingBody{body: resp.Body, t: t, ex: ex, start: start}
+		return resp, nil
+	}
+
+	//credential responses are small, they are read whole to be redacted
+	b, readErr := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	ex.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	ex.Response.setBody(redactBody(append([]byte(nil), b...)))
+	if readErr != nil {
+		ex.Error = readErr.Error()
+	}
+	t.write(ex)
+
+	//the caller still sees a read error part way through the body
+	resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(b), errReader{readErr}))
+	return resp, nil
+}
+
+// file name of an exchange, ext is json or body
+func (t *recordTransport) name(ex *httpExchange, ext string) string {
+	return fmt.Sprintf("%06d-%s.%s", ex.Sequence, ex.Operation, ext)
+}
+
+func (t *recordTransport) write(ex *httpExchange) {
+	data, err := json.MarshalIndent(ex, "", "  ")
+	if err != nil {
+		logger.Debug("record-http write failed", "error", err)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(t.dir, t.name(ex, "json")), data, 0o644); err != nil {
+		logger.Debug("record-http write failed", "error", err)
+	}
+}
+
+// recordingBody hands a response body to the caller and records what is read of it, in the
+// exchange up to maxRecordedRequestBody bytes and streamed to a body file beyond that
+type recordingBody struct {
+	body  io.ReadCloser
+	t     *recordTransport
+	ex    *httpExchange
+	start time.Time
+
+	buf    bytes.Buffer
+	file   *os.File
+	length int64
+	err    error
+	failed bool //the body file could not be written, the rest of the body is not recorded
+	once   sync.Once
+}
+
+func (r *recordingBody) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.record(p[:n])
+	}
+	if err != nil {
+		if err != io.EOF {
+			r.err = err
+		}
+		r.finish()
+	}
+	return n, err
+}
+
+func (r *recordingBody) Close() error {
+	r.finish()
+	return r.body.Close()
+}
+
+func (r *recordingBody) record(p []byte) {
+	r.length += int64(len(p))
+	if r.failed {
+		return
+	}
+	if r.file == nil && r.buf.Len()+len(p) <= maxRecordedRequestBody {
+		r.buf.Write(p)
+		return
+	}
+	if r.file == nil {
+		f, err := os.Create(filepath.Join(r.t.dir, r.t.name(r.ex, "body")))
+		if err != nil {
+			r.fail(err)
+			return
+		}
+		r.file = f
+		_, err = r.file.Write(r.buf.Bytes())
+		r.buf.Reset()
+		if err != nil {
+			r.fail(err)
+			return
+		}
+	}
+	if _, err := r.file.Write(p); err != nil {
+		r.fail(err)
+	}
+}
+
+// stops recording the body, the exchange is still written with the body length
+func (r *recordingBody) fail(err error) {
+	logger.Warn("record-http body not recorded", "file", r.t.name(r.ex, "body"), "error", err)
+	r.failed = true
+	r.buf.Reset()
+	if r.file != nil {
+		r.file.Close()
+		os.Remove(r.file.Name())
+		r.file = nil
+	}
+}
+
+// writes the exchange once the body is read to the end or closed
+func (r *recordingBody) finish() {
+	r.once.Do(func() {
+		r.ex.LatencyMs = float64(time.Since(r.start).Microseconds()) / 1000
+		if r.failed {
+			r.ex.Response.BodyLost = true
+			r.ex.Response.BodyLength = r.length
+		} else if r.file != nil {
+			r.file.Close()
+			r.ex.Response.BodyFile = r.t.name(r.ex, "body")
+			r.ex.Response.BodyLength = r.length
+		} else {
+			r.ex.Response.setBody(r.buf.Bytes())
+		}
+		if r.err != nil {
+			r.ex.Error = r.err.Error()
+		}
+		r.t.write(r.ex)
+	})
+}
+
+// errReader returns err, or io.EOF when err is nil
+type errReader struct{ err error }
+
+func (r errReader) Read(p []byte) (int, error) {
+	if r.err == nil {
+		return 0, io.EOF
+	}
+	return 0, r.err
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// replayTransport serves recorded responses instead of sending requests.
+// Requests are matched on method, path and query string (signatures excluded),
+// identical requests are answered in the order they were recorded.
+type replayTransport struct {
+	dir       string
+	mu        sync.Mutex
+	exchanges map[string][]*httpExchange
+}
+
+// identifies a request independently of host, signature and timing
+func replayKey(method string, u *url.URL) string {
+	q := u.Query()
+	for name := range q {
+		if strings.HasPrefix(name, "X-Amz-") {
+			q.Del(name)
+		}
+	}
+	for _, name := range redactedQuery {
+		q.Del(name)
+	}
+	return method + " " + u.EscapedPath() + "?" + q.Encode()
+}
+
+func newReplayTransport(dir string) (*replayTransport, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no recorded exchanges in %s", dir)
+	}
+
+	var all []*httpExchange
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		ex := &httpExchange{}
+		if err := json.Unmarshal(data, ex); err != nil {
+			return nil, fmt.Errorf("%s: %w", f, err)
+		}
+		all = append(all, ex)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Sequence < all[j].Sequence })
+
+	t := &replayTransport{dir: dir, exchanges: make(map[string][]*httpExchange)}
+	for _, ex := range all {
+		u, err := url.Parse(ex.Request.URL)
+		if err != nil {
+			return nil, fmt.Errorf("exchange %d: %w", ex.Sequence, err)
+		}
+		key := replayKey(ex.Request.Method, u)
+		t.exchanges[key] = append(t.exchanges[key], ex)
+	}
+	logger.Info("replaying HTTP exchanges", "dir", dir, "exchanges", len(all))
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	key := replayKey(req.Method, req.URL)
+
+	t.mu.Lock()
+	queue := t.exchanges[key]
+	if len(queue) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("replay-http: no recorded response left for %s", key)
+	}
+	ex := queue[0]
+	//the last response is kept to answer any further identical requests
+	if len(queue) > 1 {
+		t.exchanges[key] = queue[1:]
+	}
+	t.mu.Unlock()
+
+	logTrace("replay-http", "sequence", ex.Sequence, "operation", ex.Operation, "request", key)
+
+	if ex.Response == nil {
+		return nil, fmt.Errorf("replay-http: recorded error: %s", ex.Error)
+	}
+	if ex.Response.BodyLost {
+		return nil, fmt.Errorf("replay-http: the response body of %s was not recorded", key)
+	}
+	body, err := ex.Response.body(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	var readErr error
+	if ex.Error != "" {
+		readErr = fmt.Errorf("replay-http: recorded error: %s", ex.Error)
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", ex.Response.Status, http.StatusText(ex.Response.Status)),
+		StatusCode:    ex.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        ex.Response.Header.Clone(),
+		Body:          readCloser{io.MultiReader(body, errReader{readErr}), body},
+		ContentLength: ex.Response.BodyLength,
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestRedactHeader(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "AWS4-HMAC-SHA256 Credential=AKIA")
+	h.Add("Set-Cookie", "session=1")
+	h.Add("Set-Cookie", "token=2")
+	h.Set("Content-Type", "application/xml")
+
+	out := redactHeader(h)
+	if got := out.Values("Set-Cookie"); len(got) != 1 || got[0] != "REDACTED" {
+		t.Errorf("Set-Cookie = %q", got)
+	}
+	if out.Get("Authorization") != "REDACTED" || out.Get("Content-Type") != "application/xml" {
+		t.Errorf("redacted %v", out)
+	}
+	if h.Get("Set-Cookie") != "session=1" {
+		t.Errorf("redactHeader changed its argument")
+	}
+}
+
+// A body file that cannot be created stops the recording, not the caller
+func TestRecordingBodyFileFailure(t *testing.T) {
+	tr := &recordTransport{dir: filepath.Join(t.TempDir(), "missing")}
+	ex := &httpExchange{Sequence: 1, Operation: "GetObject", Response: &recordedHTTP{Status: 200}}
+	data := bytes.Repeat([]byte("x"), 3*maxRecordedRequestBody)
+	body := &recordingBody{body: io.NopCloser(bytes.NewReader(data)), t: tr, ex: ex}
+
+	got, err := io.ReadAll(body)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	body.Close()
+	if !body.failed || body.buf.Len() != 0 {
+		t.Errorf("failed %v, %d bytes buffered", body.failed, body.buf.Len())
+	}
+	if !ex.Response.BodyLost || ex.Response.BodyLength != int64(len(data)) || ex.Error != "" {
+		t.Errorf("recorded %+v, error %q", ex.Response, ex.Error)
+	}
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// regionClients hands out one S3 client per region, all sharing a session,
+// and remembers the region of every bucket it resolved.
+type regionClients struct {
+	sess    *session.Session
+	mu      sync.Mutex
+	clients map[string]*s3.S3
+	buckets map[string]string
+}
+
+// clients shared by every command run in this process, per session settings
+var sharedRegionClients = struct {
+	sync.Mutex
+	byKey map[string]*regionClients
+}{byKey: make(map[string]*regionClients)}
+
+// Returns the client cache for these session settings, creating the session on first use
+func regionClientsFor(fEndpointUrl string, fProfile string, fRegion string, fNoVerifySSL bool) *regionClients {
+	key := fmt.Sprint(fEndpointUrl, "|", fProfile, "|", fRegion, "|", fNoVerifySSL)
+
+	sharedRegionClients.Lock()
+	defer sharedRegionClients.Unlock()
+	rc, ok := sharedRegionClients.byKey[key]
+	if !ok {
+		rc = newRegionClients(newS3Session(fEndpointUrl, fProfile, fRegion, fNoVerifySSL))
+		sharedRegionClients.byKey[key] = rc
+	}
+	return rc
+}
+
+// Creates an S3 client on sess, signed as --signature-version selects
+func newS3Client(sess *session.Session, cfgs ...*aws.Config) *s3.S3 {
+	svc := s3.New(sess, cfgs...)
+	if fSignatureVersion == "v2" {
+		svc.Handlers.Sign.Swap(v4.SignRequestHandler.Name, s3SigV2Handler)
+	}
+	return svc
+}
+
+func newRegionClients(sess *session.Session) *regionClients {
+	return &regionClients{sess: sess, clients: make(map[string]*s3.S3), buckets: make(map[string]string)}
+}
+
+// region requests are signed for before the bucket region is known
+func (rc *regionClients) defaultRegion() string {
+	if region := aws.StringValue(rc.sess.Config.Region); region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+func (rc *regionClients) forRegion(region string) *s3.S3 {
+	if region == "" {
+		region = rc.defaultRegion()
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	svc, ok := rc.clients[region]
+	if !ok {
+		svc = newS3Client(rc.sess, &aws.Config{Region: aws.String(region)})
+		rc.clients[region] = svc
+	}
+	return svc
+}
+
+// Returns a client for the region the bucket lives in
+func (rc *regionClients) forBucket(bucket string) *s3.S3 {
+	return rc.forRegion(rc.bucketRegion(bucket))
+}
+
+// Resolves the bucket region once per bucket
+func (rc *regionClients) bucketRegion(bucket string) string {
+	rc.mu.Lock()
+	region, ok := rc.buckets[bucket]
+	rc.mu.Unlock()
+	if ok {
+		return region
+	}
+
+	region = resolveBucketRegion(rc.forRegion(""), bucket)
+	if region == "" {
+		region = rc.defaultRegion()
+		logger.Info("could not resolve the bucket region", "bucket", bucket, "region", region)
+	}
+	logTrace("bucket region", "bucket", bucket, "region", region)
+
+	rc.mu.Lock()
+	rc.buckets[bucket] = region
+	rc.mu.Unlock()
+	return region
+}
+
+// Finds the bucket region from the x-amz-bucket-region header of HeadBucket, which
+// S3 also sends with 301 redirects and 400/403 errors for the wrong region, then
+// falls back to GetBucketLocation. Returns "" when neither works.
+func resolveBucketRegion(svc *s3.S3, bucket string) string {
+	req, _ := svc.HeadBucketRequest(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	err := req.Send()
+	if req.HTTPResponse != nil {
+		if region := req.HTTPResponse.Header.Get("x-amz-bucket-region"); region != "" {
+			return region
+		}
+	}
+	logger.Debug("no x-amz-bucket-region header", "bucket", bucket, "operation", "HeadBucket", "error", err)
+
+	//S3 answers a HeadBucket that got this far with the bucket's region, other endpoints have none
+	headOK := req.HTTPResponse != nil && req.HTTPResponse.StatusCode == http.StatusOK
+	resp, err := svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		logger.Debug("bucket location failed", "bucket", bucket, "operation", "GetBucketLocation", "error", err)
+		if headOK {
+			return aws.StringValue(svc.Config.Region)
+		}
+		return ""
+	}
+	location := aws.StringValue(resp.LocationConstraint)
+	//only AWS means us-east-1 by an empty location, Ceph, MinIO and the like answer it for
+	//every bucket and requests keep the region they are signed for
+	if location == "" && (headOK || aws.StringValue(svc.Config.Endpoint) != "") {
+		return aws.StringValue(svc.Config.Region)
+	}
+	return normalizeLocationConstraint(location)
+}
+
+// Maps GetBucketLocation's legacy answers to region names
+func normalizeLocationConstraint(location string) string {
+	switch strings.ToUpper(location) {
+	case "":
+		return "us-east-1"
+	case "EU":
+		return "eu-west-1"
+	}
+	return location
+}
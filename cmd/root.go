@@ -7,6 +7,7 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -19,19 +20,80 @@ const (
 var (
 	//flag variables
 	fCfgFile     string
+	fTarget      string
 	fEndpointUrl string
 	fVerbose     bool
 	fDebug       bool
 	fTrace       bool
+	fLogLevel    string
+	fLogFormat   string
+	fLogFile     string
+	fLogMaxSize  string
+	fLogMaxFiles int
 	fNoVerifySSL bool
 	fOutput      string
 	fProfile     string
 	fRegion      string
 	fVersion     bool
+	fRecordHTTP  string
+	fReplayHTTP  string
+	fDebugHTTP   bool
+
+	fAddressingStyle string
+
+	//HTTP client settings, also read from the http section of the config file
+	fConnectTimeout        time.Duration
+	fExpectContinueTimeout time.Duration
+	fIdleConnTimeout       time.Duration
+	fKeepAlive             time.Duration
+	fMaxIdleConns          int
+	fMaxIdleConnsPerHost   int
+	fMaxConnsPerHost       int
+	fResponseHeaderTimeout time.Duration
+	fTLSHandshakeTimeout   time.Duration
+	fHTTP1Only             bool
+	fCABundle              string
+	fClientCert            string
+	fClientKey             string
+	fTLSMinVersion         string
+	fEndpointAddresses     []string
+	fEndpointBalance       string
+
+	//credential sources, also read from the credentials section of the config file
+	fAccessKey            string
+	fSecretKey            string
+	fSessionToken         string
+	fCredentialProcess    string
+	fRoleARN              string
+	fExternalID           string
+	fRoleSessionName      string
+	fRoleDuration         time.Duration
+	fWebIdentityTokenFile string
+	fSTSEndpoint          string
+	fNoSignRequest        bool
+	fSignatureVersion     string
+
+	//retry policy and concurrency of the S3 calls
+	fMaxRetries     int
+	fRetryBaseDelay time.Duration
+	fWorkers        int
+
+	//hidden testing flags
+	fInjectFaults     string
+	fInjectFaultsSeed int64
 
 	//env variables
 	ePATH string
 
+	//persistent flags that can be set in the http section of the config file
+	httpFlagNames = []string{"connect-timeout", "expect-continue-timeout", "idle-conn-timeout", "keep-alive", "max-idle-conns",
+		"max-idle-conns-per-host", "max-conns-per-host", "response-header-timeout", "tls-handshake-timeout", "http1-only",
+		"ca-bundle", "client-cert", "client-key", "tls-min-version", "endpoint-addresses", "endpoint-balance", "debug-http"}
+
+	//persistent flags that can be set in the credentials section of the config file
+	credentialFlagNames = []string{"access-key", "secret-key", "session-token", "credential-process", "role-arn", "external-id",
+		"role-session-name", "role-duration", "web-identity-token-file", "sts-endpoint", "no-sign-request", "signature-version"}
+
 	//characters to use for prefix creation
 	characters = []string{" ", "!", "&", "'", "(", ")", "+", ",", "-", ".", "/", "0", "1", "2", "3", "4", "5", "6", "7", "8", "9", ":", ";", "=", "?", "@",
 		"A", "B", "C", "D", "E", "F", "G", "H", "I", "J", "K", "L", "M", "N", "O", "P", "Q", "R", "S", "T", "U", "V", "W", "X", "Y", "Z",
@@ -76,20 +138,27 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 
-	//rootCmd.PersistentFlags().StringVar(&fCfgFile, "config", "", "config file (default is $HOME/.p53.yaml)")
+	rootCmd.PersistentFlags().StringVar(&fCfgFile, "config", "", "config file (default is $HOME/.pS3.yaml, or $PS3_CONFIG)")
+	rootCmd.PersistentFlags().StringVar(&fTarget, "target", "", "Named target from the targets section of the config file.")
 
-	rootCmd.PersistentFlags().BoolVar(&fVerbose, "verbose", false, "Turn on verbose output.")
+	rootCmd.PersistentFlags().BoolVar(&fVerbose, "verbose", false, "Turn on verbose output, same as --log-level info.")
 
 	//Debug includes verbose
-	rootCmd.PersistentFlags().BoolVar(&fDebug, "debug", false, "Turn on debug output.")
+	rootCmd.PersistentFlags().BoolVar(&fDebug, "debug", false, "Turn on debug output, same as --log-level debug.")
 	rootCmd.PersistentFlags().MarkHidden("debug")
 	//Trace includes debug and verbose
-	rootCmd.PersistentFlags().BoolVar(&fTrace, "trace", false, "Turn on trace output.")
+	rootCmd.PersistentFlags().BoolVar(&fTrace, "trace", false, "Turn on trace output, same as --log-level trace.")
 	rootCmd.PersistentFlags().MarkHidden("trace")
 
+	rootCmd.PersistentFlags().StringVar(&fLogLevel, "log-level", "", "Log level: trace, debug, info, warn or error (default warn, info with --verbose).")
+	rootCmd.PersistentFlags().StringVar(&fLogFormat, "log-format", "text", "Log format: text or json.")
+	rootCmd.PersistentFlags().StringVar(&fLogFile, "log-file", "", "Write logs to this file instead of stderr.")
+	rootCmd.PersistentFlags().StringVar(&fLogMaxSize, "log-max-size", "100MiB", "Rotate --log-file once it reaches this size, 0 to never rotate.")
+	rootCmd.PersistentFlags().IntVar(&fLogMaxFiles, "log-max-files", 5, "Rotated log files to keep.")
+
 	rootCmd.PersistentFlags().StringVar(&fEndpointUrl, "endpoint-url", "", "Override command’s default URL with the given URL")
 
-	rootCmd.PersistentFlags().BoolVar(&fNoVerifySSL, "no-verify-ssl", false, "Override SSL certificate verification")
+	rootCmd.PersistentFlags().BoolVar(&fNoVerifySSL, "no-verify-ssl", false, "Do not verify the endpoint's TLS certificate.")
 	//"By default, p53 CLI uses SSL when communicating with S3 services. For each SSL connection, the p53 CLI will verify SSL certificates. This option overrides the default behavior of verifying SSL certificates.")
 
 	rootCmd.PersistentFlags().StringVar(&fOutput, "output", "text", "The formatting style for command output: json, text.")
@@ -98,6 +167,53 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&fRegion, "region", "", "The region to use. Overrides config/env settings.")
 
+	rootCmd.PersistentFlags().StringVar(&fAddressingStyle, "addressing-style", "auto", "S3 URL style: path, virtual or auto (virtual for AWS, path for --endpoint-url).")
+
+	rootCmd.PersistentFlags().DurationVar(&fConnectTimeout, "connect-timeout", 5*time.Second, "Maximum time to establish a TCP connection.")
+	rootCmd.PersistentFlags().DurationVar(&fExpectContinueTimeout, "expect-continue-timeout", 1*time.Second, "Maximum time to wait for a 100-continue response.")
+	rootCmd.PersistentFlags().DurationVar(&fIdleConnTimeout, "idle-conn-timeout", 30*time.Second, "Time an idle connection is kept open.")
+	rootCmd.PersistentFlags().DurationVar(&fKeepAlive, "keep-alive", 10*time.Second, "TCP keep-alive period.")
+	rootCmd.PersistentFlags().IntVar(&fMaxIdleConns, "max-idle-conns", 100, "Maximum idle connections across all hosts.")
+	rootCmd.PersistentFlags().IntVar(&fMaxIdleConnsPerHost, "max-idle-conns-per-host", 100, "Maximum idle connections per host.")
+	rootCmd.PersistentFlags().IntVar(&fMaxConnsPerHost, "max-conns-per-host", 0, "Maximum connections per host, 0 for no limit.")
+	rootCmd.PersistentFlags().DurationVar(&fResponseHeaderTimeout, "response-header-timeout", 5*time.Second, "Maximum time to wait for response headers.")
+	rootCmd.PersistentFlags().DurationVar(&fTLSHandshakeTimeout, "tls-handshake-timeout", 5*time.Second, "Maximum time for the TLS handshake.")
+	rootCmd.PersistentFlags().BoolVar(&fHTTP1Only, "http1-only", false, "Do not negotiate HTTP/2.")
+	rootCmd.PersistentFlags().StringVar(&fCABundle, "ca-bundle", "", "PEM file of CA certificates to trust instead of the system roots, overrides AWS_CA_BUNDLE.")
+	rootCmd.PersistentFlags().StringVar(&fClientCert, "client-cert", "", "PEM client certificate for mutual TLS, requires --client-key.")
+	rootCmd.PersistentFlags().StringVar(&fClientKey, "client-key", "", "PEM private key of --client-cert.")
+	rootCmd.PersistentFlags().StringVar(&fTLSMinVersion, "tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3.")
+
+	rootCmd.PersistentFlags().StringSliceVar(&fEndpointAddresses, "endpoint-addresses", nil, "Spread connections to the --endpoint-url host over these IP[:port] addresses, or \"dns\" for all of its A/AAAA records. Requests use HTTP/1.1.")
+	rootCmd.PersistentFlags().StringVar(&fEndpointBalance, "endpoint-balance", "least-loaded", "How --endpoint-addresses are picked: round-robin or least-loaded.")
+
+	rootCmd.PersistentFlags().StringVar(&fAccessKey, "access-key", "", "Access key ID, instead of the environment or --profile.")
+	rootCmd.PersistentFlags().StringVar(&fSecretKey, "secret-key", "", "Secret access key of --access-key.")
+	rootCmd.PersistentFlags().StringVar(&fSessionToken, "session-token", "", "Session token of temporary --access-key credentials.")
+	rootCmd.PersistentFlags().StringVar(&fCredentialProcess, "credential-process", "", "Command printing credential_process JSON, rerun when the credentials expire.")
+	rootCmd.PersistentFlags().StringVar(&fRoleARN, "role-arn", "", "Role to assume with STS, credentials are renewed before they expire.")
+	rootCmd.PersistentFlags().StringVar(&fExternalID, "external-id", "", "External ID required by --role-arn.")
+	rootCmd.PersistentFlags().StringVar(&fRoleSessionName, "role-session-name", "", "Session name for --role-arn (default pS3-<unix time>).")
+	rootCmd.PersistentFlags().DurationVar(&fRoleDuration, "role-duration", time.Hour, "Lifetime of each set of --role-arn credentials.")
+	rootCmd.PersistentFlags().StringVar(&fWebIdentityTokenFile, "web-identity-token-file", "", "OIDC token file to assume --role-arn with (AssumeRoleWithWebIdentity).")
+	rootCmd.PersistentFlags().StringVar(&fSTSEndpoint, "sts-endpoint", "", "Override the STS URL used for --role-arn.")
+
+	rootCmd.PersistentFlags().BoolVar(&fNoSignRequest, "no-sign-request", false, "Send unsigned requests, for public buckets.")
+	rootCmd.PersistentFlags().StringVar(&fSignatureVersion, "signature-version", "v4", "Request signing: v4, or v2 for legacy S3-compatible gateways.")
+
+	rootCmd.PersistentFlags().IntVar(&fMaxRetries, "max-retries", 10, "Attempts after a failed S3 call before giving up.")
+	rootCmd.PersistentFlags().DurationVar(&fRetryBaseDelay, "retry-base-delay", time.Second, "Wait before the first retry, doubled for each further attempt.")
+	rootCmd.PersistentFlags().IntVar(&fWorkers, "workers", maxSemaphore, "Concurrent S3 calls and output workers.")
+
+	rootCmd.PersistentFlags().BoolVar(&fDebugHTTP, "debug-http", false, "Log every HTTP request and response, with credentials redacted.")
+	rootCmd.PersistentFlags().StringVar(&fRecordHTTP, "record-http", "", "Write every HTTP request/response pair to this directory, credentials are redacted.")
+	rootCmd.PersistentFlags().StringVar(&fReplayHTTP, "replay-http", "", "Answer requests from a --record-http directory instead of the network.")
+
+	rootCmd.PersistentFlags().StringVar(&fInjectFaults, "inject-faults", "", "Randomly fail requests for resilience testing, e.g. \"503=0.05,reset=0.01;ListObjectsV2:truncate=0.02,latency=0.1@500ms\"")
+	rootCmd.PersistentFlags().MarkHidden("inject-faults")
+	rootCmd.PersistentFlags().Int64Var(&fInjectFaultsSeed, "inject-faults-seed", 0, "Random seed for --inject-faults, 0 picks one from the clock")
+	rootCmd.PersistentFlags().MarkHidden("inject-faults-seed")
+
 	rootCmd.Flags().BoolVar(&fVersion, "version", false, "Display version information.")
 
 	// Cobra also supports local flags, which will only run
@@ -111,6 +227,9 @@ func initConfig() {
 	ePATH = viper.Get("PATH").(string)
 	//fmt.Printf("debug: %s\n", ePATH)
 
+	if fCfgFile == "" {
+		fCfgFile = os.Getenv("PS3_CONFIG")
+	}
 	if fCfgFile != "" {
 		// Use config file from the flag.
 		viper.SetConfigFile(fCfgFile)
@@ -125,10 +244,30 @@ func initConfig() {
 		viper.SetConfigName(".pS3")
 	}
 
-	viper.AutomaticEnv() // read in environment variables that match
-
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	} else if fCfgFile != "" {
+		fmt.Fprintln(os.Stderr, "error: config file:", err)
+		os.Exit(1)
+	}
+
+	if err := resolveConfig(rootCmd.PersistentFlags()); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	if err := initLogging(); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+	for name, source := range configSources {
+		if source != "default" {
+			logTrace("config", "flag", name, "source", source)
+		}
+	}
+	if fWorkers < 1 {
+		fmt.Fprintln(os.Stderr, "error: --workers must be at least 1")
+		os.Exit(1)
 	}
+	maxSemaphore = fWorkers
 }
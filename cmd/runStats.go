@@ -0,0 +1,263 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// listing statistics for --stats and --stats-file, nil when neither is set
+var stats *runStats
+
+// runStats collects the request, retry and discovery figures of one listing.
+// Its methods do nothing on a nil receiver so callers need not check.
+type runStats struct {
+	mu       sync.Mutex
+	start    time.Time
+	ops      map[string]*opStats
+	retries  map[string]int64
+	counters map[string]int64
+	phases   map[string]time.Duration
+}
+
+type opStats struct {
+	calls     int64
+	errors    int64
+	sent      int64
+	received  int64
+	latencies []time.Duration
+}
+
+func newRunStats() *runStats {
+	return &runStats{
+		start:    time.Now(),
+		ops:      make(map[string]*opStats),
+		retries:  make(map[string]int64),
+		counters: make(map[string]int64),
+		phases:   make(map[string]time.Duration),
+	}
+}
+
+// records one HTTP exchange of operation op
+func (s *runStats) request(op string, latency time.Duration, sent int64, received int64, failed bool) {
+	if s == nil {
+		return
+	}
+	if op == "" {
+		op = "other"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o, ok := s.ops[op]
+	if !ok {
+		o = &opStats{}
+		s.ops[op] = o
+	}
+	o.calls++
+	if failed {
+		o.errors++
+	}
+	if sent > 0 {
+		o.sent += sent
+	}
+	o.received += received
+	o.latencies = append(o.latencies, latency)
+}
+
+// records a retry caused by err
+func (s *runStats) retry(err error) {
+	if s == nil {
+		return
+	}
+	code := "other"
+	if awsErr, ok := err.(awserr.Error); ok {
+		code = awsErr.Code()
+	}
+	s.mu.Lock()
+	s.retries[code]++
+	s.mu.Unlock()
+}
+
+func (s *runStats) add(counter string, n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.counters[counter] += n
+	s.mu.Unlock()
+}
+
+// starts timing a phase, the returned func ends it
+func (s *runStats) phase(name string) func() {
+	if s == nil {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		s.mu.Lock()
+		s.phases[name] += time.Since(start)
+		s.mu.Unlock()
+	}
+}
+
+// statsRetryer is the SDK's default retryer, counting each retry it schedules
+type statsRetryer struct {
+	client.DefaultRetryer
+}
+
+func (r statsRetryer) RetryRules(req *request.Request) time.Duration {
+	stats.retry(req.Error)
+	return r.DefaultRetryer.RetryRules(req)
+}
+
+// statsTransport feeds every HTTP exchange to stats, timed until the body is closed
+type statsTransport struct {
+	next http.RoundTripper
+}
+
+func (t *statsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	op := s3OperationName(req)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		stats.request(op, time.Since(start), req.ContentLength, 0, true)
+		return resp, err
+	}
+	failed := resp.StatusCode >= 400
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: func(received int64, readErr error) {
+		stats.request(op, time.Since(start), req.ContentLength, received, failed || (readErr != nil && readErr != io.EOF))
+	}}
+	return resp, nil
+}
+
+type opReport struct {
+	Calls         int64   `json:"calls"`
+	Errors        int64   `json:"errors"`
+	BytesSent     int64   `json:"bytes_sent"`
+	BytesReceived int64   `json:"bytes_received"`
+	P50Ms         float64 `json:"p50_ms"`
+	P90Ms         float64 `json:"p90_ms"`
+	P99Ms         float64 `json:"p99_ms"`
+	MaxMs         float64 `json:"max_ms"`
+}
+
+type statsReport struct {
+	Operations map[string]opReport `json:"operations"`
+	Retries    map[string]int64    `json:"retries"`
+	Prefixes   struct {
+		Small           int64 `json:"small"`
+		LargeDiscovered int64 `json:"large_discovered"`
+		SweepRanges     int64 `json:"sweep_ranges"`
+		LargeListed     int64 `json:"large_listed"`
+		Splits          int64 `json:"splits"`
+		SplitPieces     int64 `json:"split_pieces"`
+	} `json:"prefixes"`
+	ProbeLists struct {
+		Total  int64 `json:"total"`
+		Empty  int64 `json:"empty"`
+		Large  int64 `json:"large"`
+		Wasted int64 `json:"wasted"`
+	} `json:"probe_lists"`
+	PhasesMs map[string]float64 `json:"phases_ms"`
+}
+
+func (s *runStats) report() statsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var r statsReport
+	r.Operations = make(map[string]opReport)
+	for name, o := range s.ops {
+		sorted := append([]time.Duration(nil), o.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		r.Operations[name] = opReport{
+			Calls:         o.calls,
+			Errors:        o.errors,
+			BytesSent:     o.sent,
+			BytesReceived: o.received,
+			P50Ms:         durationMs(percentile(sorted, 50)),
+			P90Ms:         durationMs(percentile(sorted, 90)),
+			P99Ms:         durationMs(percentile(sorted, 99)),
+			MaxMs:         durationMs(percentile(sorted, 100)),
+		}
+	}
+	r.Retries = make(map[string]int64)
+	for code, n := range s.retries {
+		r.Retries[code] = n
+	}
+
+	r.Prefixes.Small = s.counters["small_prefixes"]
+	r.Prefixes.LargeDiscovered = s.counters["large_prefixes_discovered"]
+	r.Prefixes.SweepRanges = s.counters["sweep_ranges"]
+	r.Prefixes.LargeListed = s.counters["large_prefixes_listed"]
+	r.Prefixes.Splits = s.counters["partition_splits"]
+	r.Prefixes.SplitPieces = s.counters["partition_pieces"]
+	//probes that found nothing, or more than a page which is listed again later
+	r.ProbeLists.Total = s.counters["probe_lists"]
+	r.ProbeLists.Empty = s.counters["probe_lists_empty"]
+	r.ProbeLists.Large = s.counters["probe_lists_large"]
+	r.ProbeLists.Wasted = r.ProbeLists.Empty + r.ProbeLists.Large
+
+	r.PhasesMs = make(map[string]float64)
+	for name, d := range s.phases {
+		r.PhasesMs[name] = durationMs(d)
+	}
+	r.PhasesMs["total"] = durationMs(time.Since(s.start))
+	return r
+}
+
+// Prints the report to w when print is set and writes it as JSON to file when it is not empty
+func (s *runStats) write(w io.Writer, print bool, file string) error {
+	if s == nil {
+		return nil
+	}
+	r := s.report()
+
+	if file != "" {
+		out, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(file, append(out, '\n'), 0o644); err != nil {
+			return err
+		}
+	}
+	if !print {
+		return nil
+	}
+
+	var names []string
+	for name := range r.Operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(w, "%-20s %8s %7s %12s %12s %10s %10s %10s %10s\n", "OPERATION", "CALLS", "ERRORS", "BYTES OUT", "BYTES IN", "P50(ms)", "P90(ms)", "P99(ms)", "MAX(ms)")
+	for _, name := range names {
+		o := r.Operations[name]
+		fmt.Fprintf(w, "%-20s %8d %7d %12d %12d %10.2f %10.2f %10.2f %10.2f\n", name, o.Calls, o.Errors, o.BytesSent, o.BytesReceived, o.P50Ms, o.P90Ms, o.P99Ms, o.MaxMs)
+	}
+
+	var retries []string
+	for code, n := range r.Retries {
+		retries = append(retries, fmt.Sprintf("%s=%d", code, n))
+	}
+	sort.Strings(retries)
+	if len(retries) == 0 {
+		retries = []string{"none"}
+	}
+	fmt.Fprintln(w, "retries:    ", strings.Join(retries, " "))
+	fmt.Fprintf(w, "prefixes:     %d small, %d large discovered, %d sweep ranges, %d ranges listed, %d straggler splits into %d pieces\n", r.Prefixes.Small, r.Prefixes.LargeDiscovered, r.Prefixes.SweepRanges, r.Prefixes.LargeListed, r.Prefixes.Splits, r.Prefixes.SplitPieces)
+	fmt.Fprintf(w, "probe LISTs:  %d, %d wasted (%d empty, %d over 999 keys)\n", r.ProbeLists.Total, r.ProbeLists.Wasted, r.ProbeLists.Empty, r.ProbeLists.Large)
+	fmt.Fprintf(w, "wall clock:   discovery %.0fms, parallel listing %.0fms, total %.0fms\n", r.PhasesMs["discovery"], r.PhasesMs["parallel_listing"], r.PhasesMs["total"])
+	return nil
+}
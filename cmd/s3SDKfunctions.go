@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
 	"math"
 	"time"
@@ -53,114 +54,37 @@ func s3listObjects(svc *s3.S3, bucketName string, prefix string, startKey string
 	return resp, nil
 }
 
-func s3ListObjectsWithBackOff(svc *s3.S3, bucketName string, prefix string, startKey string, startVersion string, maxKeys int64) (*s3.ListObjectsV2Output, error) {
-
-	maxRetries := 10
-
-	for {
-		//Define the parameters for the listObject API call
-		params := &s3.ListObjectsV2Input{
-			Bucket:  aws.String(bucketName),
-			MaxKeys: aws.Int64(maxKeys),
-			//FIX REMOVE:   Delimiter: aws.String("/"),
-		}
-
-		if prefix != "" {
-			params.Prefix = aws.String(prefix)
-		}
-
-		for i := 0; ; i++ {
-			//Make the API call
-			resp, err := svc.ListObjectsV2(params)
-			if err != nil {
-				return resp, nil
-			}
-			if err == nil {
-				return resp, nil
-			} else {
-				if awsErr, ok := err.(awserr.Error); ok {
-					switch awsErr.Code() {
-					case s3.ErrCodeNoSuchBucket:
-						return nil, fmt.Errorf("bucket %s does not exist: %w", bucketName, err)
-					default:
-						if i >= maxRetries {
-							return nil, fmt.Errorf("too many failed attempts to list objects: %w", err)
-						}
-
-						wait := time.Duration(math.Exp2(float64(i))) * time.Second
-						TracePrintln("got error", err, "retrying after", wait)
-						time.Sleep(wait)
-					}
-				} else {
-					return nil, fmt.Errorf("unknown error occurred: %w", err)
-				}
-			}
-		}
+// Lists one page of objects for a prefix, starting after startKey
+func s3ListObjectsWithBackOff(svc s3Lister, bucketName string, prefix string, startKey string, startVersion string, maxKeys int64) (*s3.ListObjectsV2Output, error) {
+	//Define the parameters for the listObject API call
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucketName),
+		MaxKeys: aws.Int64(maxKeys),
 	}
-}
-
-func s3ListAllObjectsWithBackoff(svc *s3.S3, bucketName string, prefix string, startKey string, startVersion string, maxKeys int64, chs3Object chan<- *s3.Object) (int, error) {
 
-	var continuationToken *string
-	var thiscount int
-	maxRetries := 10
-
-	for {
-		params := &s3.ListObjectsV2Input{
-			Bucket:            aws.String(bucketName),
-			ContinuationToken: continuationToken,
-			MaxKeys:           aws.Int64(maxKeys),
-		}
-		if prefix != "" {
-			params.Prefix = aws.String(prefix)
-		}
-
-		for i := 0; ; i++ {
-			result, err := svc.ListObjectsV2(params)
-			if err == nil {
-				for _, object := range result.Contents {
+	if prefix != "" {
+		params.Prefix = aws.String(prefix)
+	}
 
-					chs3Object <- object
-					thiscount++
-				}
-				if result.IsTruncated != nil && *result.IsTruncated {
-					continuationToken = result.NextContinuationToken
-				} else {
-					continuationToken = nil
-				}
-				break
-			} else {
-				if awsErr, ok := err.(awserr.Error); ok {
-					switch awsErr.Code() {
-					case s3.ErrCodeNoSuchBucket:
-						return 0, fmt.Errorf("bucket %s does not exist: %w", bucketName, err)
-						//return nil, fmt.Errorf("bucket %s does not exist: %w", bucketName, err)
-
-					default:
-						if i >= maxRetries {
-							return 0, fmt.Errorf("too many failed attempts to list objects: %w", err)
-							//return nil, fmt.Errorf("too many failed attempts to list objects: %w", err)
-
-						}
-
-						wait := time.Duration(math.Exp2(float64(i))) * time.Second
-						TracePrintln("got error", err, "retrying after", wait)
-						time.Sleep(wait)
-					}
-				} else {
-					//return nil, fmt.Errorf("unknown error occurred: %w", err)
-					return 0, fmt.Errorf("unknown error occurred: %w", err)
+	if startKey != "" {
+		params.StartAfter = aws.String(startKey)
+	}
 
-				}
-			}
-		}
+	return s3ListObjectsV2PageWithBackoff(svc, bucketName, params)
+}
 
-		if continuationToken == nil {
-			break
-		}
+// Lists one page of objects, retrying throttling and server errors with an exponential backoff
+func s3ListObjectsV2PageWithBackoff(svc s3Lister, bucketName string, params *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	var resp *s3.ListObjectsV2Output
+	err := s3WithBackoff(bucketName, "ListObjectsV2", "list objects", func() error {
+		var err error
+		resp, err = svc.ListObjectsV2(params)
+		return err
+	}, "prefix", aws.StringValue(params.Prefix))
+	if err != nil {
+		return nil, err
 	}
-
-	return thiscount, nil
+	return resp, nil
 }
 
 func s3listObjectsFilter(svc *s3.S3, bucketName string, prefix string, startKey string, startVersion string, maxKeys int64) ([]*s3.Object, error) {
@@ -255,17 +179,52 @@ func s3listObjectVersionsFilter(svc *s3.S3, bucketName string, key string, start
 
 }
 
-// Gets the location of a bucket
-func getBucketLocation(svc *s3.S3, fBucketName string) (string, error) {
-	resp, err := svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String(fBucketName)})
-	if err != nil {
-		return "", err
-	}
+// Puts an object, retrying throttling and server errors with an exponential backoff
+func s3PutObjectWithBackoff(svc *s3.S3, bucketName string, key string, body []byte) error {
+	return s3WithBackoff(bucketName, "PutObject", "put object", func() error {
+		_, err := svc.PutObject(&s3.PutObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(key),
+			Body:   bytes.NewReader(body),
+		})
+		return err
+	}, "key", key)
+}
 
-	// If the location is not set or is us-east-1, return an empty string (us-east-1 is the default region)
-	if resp.LocationConstraint == nil || *resp.LocationConstraint == "us-east-1" {
-		return "", nil
+// Calls call until it succeeds, retrying errors other than a missing bucket up to --max-retries
+// times with an exponential backoff. what names the call in errors, logArgs are added to the
+// retry log lines.
+func s3WithBackoff(bucketName string, operation string, what string, call func() error, logArgs ...any) error {
+
+	maxRetries := fMaxRetries
+
+	for i := 0; ; i++ {
+		err := call()
+		if err == nil {
+			return nil
+		}
+		if awsErr, ok := err.(awserr.Error); ok {
+			switch awsErr.Code() {
+			case s3.ErrCodeNoSuchBucket:
+				return fmt.Errorf("bucket %s does not exist: %w", bucketName, err)
+			default:
+				if i >= maxRetries {
+					return fmt.Errorf("too many failed attempts to %s: %w", what, err)
+				}
+
+				wait := retryDelay(i)
+				args := append([]any{"bucket", bucketName}, logArgs...)
+				logger.Debug("retrying", append(args, "operation", operation, "attempt", i+1, "wait", wait, "error", err)...)
+				stats.retry(err)
+				time.Sleep(wait)
+			}
+		} else {
+			return fmt.Errorf("unknown error occurred: %w", err)
+		}
 	}
+}
 
-	return *resp.LocationConstraint, nil
+// Wait before retry attempt i, doubling from --retry-base-delay
+func retryDelay(i int) time.Duration {
+	return time.Duration(math.Exp2(float64(i))) * fRetryBaseDelay
 }
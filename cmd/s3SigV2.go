@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// query parameters that are part of the signed resource in S3 signature version 2
+var s3SigV2SubResources = map[string]bool{
+	"acl": true, "cors": true, "delete": true, "lifecycle": true, "location": true, "logging": true,
+	"notification": true, "partNumber": true, "policy": true, "requestPayment": true, "restore": true,
+	"tagging": true, "torrent": true, "uploadId": true, "uploads": true, "versionId": true,
+	"versioning": true, "versions": true, "website": true,
+	"response-cache-control": true, "response-content-disposition": true, "response-content-encoding": true,
+	"response-content-language": true, "response-content-type": true, "response-expires": true,
+}
+
+// s3SigV2Handler signs S3 REST requests with the legacy "AWS key:signature" scheme,
+// for gateways that predate SigV4. It takes the place of the SDK's v4 handler.
+var s3SigV2Handler = request.NamedHandler{Name: v4.SignRequestHandler.Name, Fn: signS3V2}
+
+func signS3V2(r *request.Request) {
+	if r.Config.Credentials == credentials.AnonymousCredentials {
+		return
+	}
+	creds, err := r.Config.Credentials.GetWithContext(r.Context())
+	if err != nil {
+		r.Error = err
+		return
+	}
+
+	req := r.HTTPRequest
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	bucket := ""
+	if endpoint, err := url.Parse(r.ClientInfo.Endpoint); err == nil {
+		host, endpointHost := req.URL.Hostname(), endpoint.Hostname()
+		if strings.HasSuffix(host, "."+endpointHost) {
+			bucket = strings.TrimSuffix(host, "."+endpointHost)
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(creds.SecretAccessKey))
+	mac.Write([]byte(s3SigV2StringToSign(req, bucket)))
+	req.Header.Set("Authorization", "AWS "+creds.AccessKeyID+":"+base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// The canonical request of signature version 2. bucket is set for virtual-hosted
+// requests, where it is part of the host instead of the path.
+func s3SigV2StringToSign(req *http.Request, bucket string) string {
+	var sb strings.Builder
+	sb.WriteString(req.Method + "\n")
+	sb.WriteString(req.Header.Get("Content-MD5") + "\n")
+	sb.WriteString(req.Header.Get("Content-Type") + "\n")
+	sb.WriteString(req.Header.Get("Date") + "\n")
+
+	var amzHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			amzHeaders = append(amzHeaders, lower)
+		}
+	}
+	sort.Strings(amzHeaders)
+	for _, name := range amzHeaders {
+		sb.WriteString(name + ":" + strings.Join(req.Header.Values(name), ",") + "\n")
+	}
+
+	if bucket != "" {
+		sb.WriteString("/" + bucket)
+	}
+	sb.WriteString(req.URL.EscapedPath())
+
+	query := req.URL.Query()
+	var subResources []string
+	for name := range query {
+		if s3SigV2SubResources[name] {
+			subResources = append(subResources, name)
+		}
+	}
+	sort.Strings(subResources)
+	for i, name := range subResources {
+		if i == 0 {
+			sb.WriteString("?")
+		} else {
+			sb.WriteString("&")
+		}
+		sb.WriteString(name)
+		if v := query.Get(name); v != "" {
+			sb.WriteString("=" + v)
+		}
+	}
+	return sb.String()
+}
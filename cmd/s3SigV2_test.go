@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+// The examples of the Amazon S3 "Signing and authenticating REST requests" guide
+func TestS3SigV2StringToSign(t *testing.T) {
+	const secret = "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		bucket    string
+		header    map[string][]string
+		want      string
+		signature string
+	}{
+		{
+			name:      "object GET",
+			method:    "GET",
+			url:       "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg",
+			bucket:    "johnsmith",
+			header:    map[string][]string{"Date": {"Tue, 27 Mar 2007 19:36:42 +0000"}},
+			want:      "GET\n\n\nTue, 27 Mar 2007 19:36:42 +0000\n/johnsmith/photos/puppy.jpg",
+			signature: "bWq2s1WEIj+Ydj0vQ697zp+IXMU=",
+		},
+		{
+			name:   "object PUT",
+			method: "PUT",
+			url:    "https://johnsmith.s3.amazonaws.com/photos/puppy.jpg",
+			bucket: "johnsmith",
+			header: map[string][]string{
+				"Content-Type":   {"image/jpeg"},
+				"Content-Length": {"94328"},
+				"Date":           {"Tue, 27 Mar 2007 21:15:45 +0000"},
+			},
+			want:      "PUT\n\nimage/jpeg\nTue, 27 Mar 2007 21:15:45 +0000\n/johnsmith/photos/puppy.jpg",
+			signature: "MyyxeRY7whkBe+bq8fHCL/2kKUg=",
+		},
+		{
+			name:   "list, query parameters are not signed",
+			method: "GET",
+			url:    "https://johnsmith.s3.amazonaws.com/?prefix=photos&max-keys=50&marker=puppy",
+			bucket: "johnsmith",
+			header: map[string][]string{
+				"User-Agent": {"Mozilla/5.0"},
+				"Date":       {"Tue, 27 Mar 2007 19:42:41 +0000"},
+			},
+			want:      "GET\n\n\nTue, 27 Mar 2007 19:42:41 +0000\n/johnsmith/",
+			signature: "htDYFYduRNen8P9ZfE/s9SuKy0U=",
+		},
+		{
+			name:      "sub-resource",
+			method:    "GET",
+			url:       "https://johnsmith.s3.amazonaws.com/?acl",
+			bucket:    "johnsmith",
+			header:    map[string][]string{"Date": {"Tue, 27 Mar 2007 19:44:46 +0000"}},
+			want:      "GET\n\n\nTue, 27 Mar 2007 19:44:46 +0000\n/johnsmith/?acl",
+			signature: "c2WLPFtWHVgbEmeEG93a4cG37dM=",
+		},
+		{
+			name:   "x-amz headers lower cased, sorted and joined",
+			method: "PUT",
+			url:    "http://static.johnsmith.net:8080/db-backup.dat.gz",
+			bucket: "static.johnsmith.net",
+			header: map[string][]string{
+				"Date":                         {"Tue, 27 Mar 2007 21:06:08 +0000"},
+				"X-Amz-Acl":                    {"public-read"},
+				"Content-Type":                 {"application/x-download"},
+				"Content-Md5":                  {"4gJE4saaMU4BqNR0kLY+lw=="},
+				"X-Amz-Meta-Reviewedby":        {"joe@johnsmith.net", "jane@johnsmith.net"},
+				"X-Amz-Meta-Filechecksum":      {"0x02661779"},
+				"X-Amz-Meta-Checksumalgorithm": {"crc32"},
+				"Content-Length":               {"5913339"},
+			},
+			want: "PUT\n4gJE4saaMU4BqNR0kLY+lw==\napplication/x-download\nTue, 27 Mar 2007 21:06:08 +0000\n" +
+				"x-amz-acl:public-read\nx-amz-meta-checksumalgorithm:crc32\nx-amz-meta-filechecksum:0x02661779\n" +
+				"x-amz-meta-reviewedby:joe@johnsmith.net,jane@johnsmith.net\n/static.johnsmith.net/db-backup.dat.gz",
+			signature: "ilyl83RwaSoYIEdixDQcA4OnAnc=",
+		},
+		{
+			name:   "path style, sub-resources sorted by name with their values",
+			method: "PUT",
+			url:    "https://s3.amazonaws.com/johnsmith/big.bin?uploadId=abc&partNumber=2&max-keys=5",
+			header: map[string][]string{"Date": {"Tue, 27 Mar 2007 19:44:46 +0000"}},
+			want:   "PUT\n\n\nTue, 27 Mar 2007 19:44:46 +0000\n/johnsmith/big.bin?partNumber=2&uploadId=abc",
+		},
+		{
+			name:   "versions listing",
+			method: "GET",
+			url:    "https://s3.amazonaws.com/johnsmith/?versions&prefix=a&versionId=v1",
+			header: map[string][]string{"Date": {"Tue, 27 Mar 2007 19:44:46 +0000"}},
+			want:   "GET\n\n\nTue, 27 Mar 2007 19:44:46 +0000\n/johnsmith/?versionId=v1&versions",
+		},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, values := range tt.header {
+			for _, v := range values {
+				req.Header.Add(name, v)
+			}
+		}
+		got := s3SigV2StringToSign(req, tt.bucket)
+		if got != tt.want {
+			t.Errorf("%s: string to sign\n%q, want\n%q", tt.name, got, tt.want)
+		}
+		if tt.signature == "" {
+			continue
+		}
+		mac := hmac.New(sha1.New, []byte(secret))
+		mac.Write([]byte(got))
+		if sig := base64.StdEncoding.EncodeToString(mac.Sum(nil)); sig != tt.signature {
+			t.Errorf("%s: signature %s, want %s", tt.name, sig, tt.signature)
+		}
+	}
+}